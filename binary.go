@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// buildCmd implements the build subcommand: it builds a main package
+// with coverage instrumentation, so that whole applications can be
+// sliced. The binary writes the coverage data to the directory in the
+// GOCOVERDIR environment variable on every run; the data is then turned
+// into coverage results by collect -covdata.
+func buildCmd(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	out := fs.String("o", "", "write the binary to `file` (default: the name of the package)")
+	coverPkg := fs.String("coverpkg", "", "instrument the packages matching `patterns` (default: the packages of the main module)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] build [build flags] <main package>\n\nBuild flags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+
+	goArgs := []string{"build", "-cover", "-covermode=" + *coverMode}
+	if *coverPkg != "" {
+		goArgs = append(goArgs, "-coverpkg="+*coverPkg)
+	}
+	if *out != "" {
+		goArgs = append(goArgs, "-o", *out)
+	}
+	if *race {
+		goArgs = append(goArgs, "-race")
+	}
+	cmd := exec.Command("go", append(goArgs, fs.Arg(0))...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("building %s: %v", fs.Arg(0), err)
+	}
+	return nil
+}
+
+// covdataResults returns the coverage results of the binary coverage data
+// in the comma-separated list of directories dirs, together with the cover
+// mode of the data. The files are looked up relative to srcDir.
+func covdataResults(dirs string) (mode string, results []*CoverResult, err error) {
+	f, err := ioutil.TempFile("", "slicer-profile-")
+	if err != nil {
+		return "", nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cmd := exec.Command("go", "tool", "covdata", "textfmt", "-i="+dirs, "-o", f.Name())
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", nil, fmt.Errorf("reading coverage data in %s: %v", dirs, err)
+	}
+	pf, err := os.Open(f.Name())
+	if err != nil {
+		return "", nil, err
+	}
+	defer pf.Close()
+	mode, results, err = parseProfile(pf)
+	if err != nil {
+		return "", nil, fmt.Errorf("parsing coverage profile: %v", err)
+	}
+	for _, cr := range results {
+		if err := locateFile(cr); err != nil {
+			return "", nil, err
+		}
+		if cr.Hash, err = fileHash(cr.Filename); err != nil {
+			return "", nil, err
+		}
+	}
+	return mode, results, nil
+}
+
+var profileRx = regexp.MustCompile(`^(.+):(\d+)\.(\d+),(\d+)\.(\d+) (\d+) (\d+)$`)
+
+// parseProfile parses a coverage profile in the format written by
+// go test -coverprofile. The files in the profile are named by their
+// import paths, so the results have the package set, but not the
+// real filename. The counts of blocks listed more than once are added.
+func parseProfile(r io.Reader) (mode string, results []*CoverResult, err error) {
+	sc := bufio.NewScanner(r)
+	if !sc.Scan() {
+		if err := sc.Err(); err != nil {
+			return "", nil, err
+		}
+		return "", nil, fmt.Errorf("empty profile")
+	}
+	mode = strings.TrimPrefix(sc.Text(), "mode: ")
+	if mode == sc.Text() {
+		return "", nil, fmt.Errorf("missing mode line: %q", sc.Text())
+	}
+
+	type file struct {
+		cr     *CoverResult
+		counts map[CoverPos]int
+		order  []CoverPos
+	}
+	files := make(map[string]*file)
+	var order []string
+	for sc.Scan() {
+		l := sc.Text()
+		m := profileRx.FindStringSubmatch(l)
+		if m == nil {
+			return "", nil, fmt.Errorf("error parsing: %q", l)
+		}
+		f := files[m[1]]
+		if f == nil {
+			f = &file{
+				cr:     &CoverResult{Filename: m[1], Package: path.Dir(m[1])},
+				counts: make(map[CoverPos]int),
+			}
+			files[m[1]] = f
+			order = append(order, m[1])
+		}
+		pos := CoverPos{
+			Line0: toInt(m[2]),
+			Col0:  toInt(m[3]),
+			Line1: toInt(m[4]),
+			Col1:  toInt(m[5]),
+		}
+		if _, ok := f.counts[pos]; !ok {
+			f.order = append(f.order, pos)
+		}
+		if mode == "set" {
+			f.counts[pos] |= toInt(m[7])
+		} else {
+			f.counts[pos] += toInt(m[7])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", nil, err
+	}
+
+	for _, name := range order {
+		f := files[name]
+		for _, pos := range f.order {
+			if cnt := f.counts[pos]; cnt == 0 {
+				f.cr.Removes = append(f.cr.Removes, pos)
+			} else {
+				f.cr.Hits = append(f.cr.Hits, CoverHit{pos, cnt})
+			}
+		}
+		results = append(results, f.cr)
+	}
+	return mode, results, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProfile(t *testing.T) {
+	prof := "mode: count\n" +
+		"example.com/app/lib/lib.go:4.2,4.11 1 2\n" +
+		"example.com/app/lib/lib.go:7.2,7.10 1 0\n" +
+		"example.com/app/main.go:10.15,10.49 1 1\n" +
+		"example.com/app/lib/lib.go:4.2,4.11 1 3\n"
+	mode, results, err := parseProfile(strings.NewReader(prof))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != "count" {
+		t.Errorf("got mode %q, want count", mode)
+	}
+	want := []*CoverResult{
+		{
+			Filename: "example.com/app/lib/lib.go",
+			Package:  "example.com/app/lib",
+			Removes:  []CoverPos{{7, 2, 7, 10}},
+			Hits:     []CoverHit{{CoverPos{4, 2, 4, 11}, 5}},
+		},
+		{
+			Filename: "example.com/app/main.go",
+			Package:  "example.com/app",
+			Hits:     []CoverHit{{CoverPos{10, 15, 10, 49}, 1}},
+		},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got %+v, want %+v", results, want)
+	}
+
+	for _, bad := range []string{"", "example.com/app/main.go:1.1,2.2 1 1\n", "mode: set\nmain.go:1.1 1 1\n"} {
+		if _, _, err := parseProfile(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
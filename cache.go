@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "slicer")
+}
+
+// cacheKey returns a hex encoded hash of parts. Every part is prefixed
+// with its length so that different splits of the same bytes don't
+// produce the same key.
+func cacheKey(parts ...[]byte) string {
+	h := sha256.New()
+	var n [8]byte
+	for _, p := range parts {
+		binary.BigEndian.PutUint64(n[:], uint64(len(p)))
+		h.Write(n[:])
+		h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func checksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func cachePath(kind, key string) string {
+	return filepath.Join(*cacheDir, kind, key[:2], key)
+}
+
+// cacheGet returns the data stored under key. It always reports
+// a miss if caching is disabled. Entries not matching their checksum
+// are reported as misses too.
+func cacheGet(kind, key string) ([]byte, bool) {
+	if *cacheDir == "" {
+		return nil, false
+	}
+	b, err := ioutil.ReadFile(cachePath(kind, key))
+	if err != nil {
+		return nil, false
+	}
+	if len(b) < sha256.Size || !bytes.Equal(b[:sha256.Size], checksum(b[sha256.Size:])) {
+		Verbosef("Ignoring corrupt cache entry %s", cachePath(kind, key))
+		return nil, false
+	}
+	return b[sha256.Size:], true
+}
+
+// cachePut stores data under key, preceded by its checksum. As the cache
+// is only an optimisation, failures are logged, not returned.
+func cachePut(kind, key string, data []byte) {
+	if *cacheDir == "" {
+		return
+	}
+	filename := cachePath(kind, key)
+	if err := writeFileAtomic(filename, append(checksum(data), data...)); err != nil {
+		log.Printf("Caching %s: %v", filename, err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file first and renames it
+// afterwards, so that concurrent readers never see a partial file.
+func writeFileAtomic(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+var (
+	goVersionOnce sync.Once
+	goVersionStr  string
+)
+
+// goVersion returns the version of the go command that instruments and
+// runs the code. Outputs of different versions must not be mixed.
+func goVersion() string {
+	goVersionOnce.Do(func() {
+		out, err := exec.Command("go", "env", "GOVERSION").Output()
+		if err != nil {
+			log.Fatalf("Determining Go version: %v", err)
+		}
+		goVersionStr = strings.TrimSpace(string(out))
+	})
+	return goVersionStr
+}
+
+// coverResultsKey returns the key of the coverage results of running
+// the template consisting of tmplFiles against the instrumented files
+// of the packages pkgs on the platform pl.
+// The arguments, the environment variables set by -env and the standard
+// input of the run are part of the key; the inherited environment isn't.
+// Neither are the files of the standard library, which come with the Go
+// version, but the files of all the other dependencies of pkgs are. The
+// files of pkgs must already be instrumented in the coverage program.
+func coverResultsKey(tmplFiles []string, pkgs []string, files []CoverFile, pl platform) (string, error) {
+	parts := [][]byte{[]byte(goVersion()), []byte(*coverMode), []byte(strconv.FormatBool(*race)), []byte(pl.String())}
+	parts = append(parts, []byte(strings.Join(progArgs, "\x00")), []byte(strings.Join(progEnv, "\x00")))
+	// The timeout is the deadline of the context of a slice function.
+	parts = append(parts, []byte(timeout.String()))
+	stdin := []byte("no stdin")
+	if *progStdin != "" {
+		b, err := ioutil.ReadFile(*progStdin)
+		if err != nil {
+			return "", err
+		}
+		stdin = append([]byte("stdin:"), b...)
+	}
+	parts = append(parts, stdin)
+	for _, name := range tmplFiles {
+		code, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, []byte(name), code)
+	}
+	for _, f := range files {
+		code, err := ioutil.ReadFile(f.Name)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, []byte(f.Name), []byte(f.Var), code)
+	}
+	deps, err := depsKeyParts(pkgs, pl)
+	if err != nil {
+		return "", err
+	}
+	return cacheKey(append(parts, deps...)...), nil
+}
+
+// listedPkg is the part of the output of go list -json describing the
+// files of a package.
+type listedPkg struct {
+	ImportPath string
+	Dir        string
+	Standard   bool
+
+	GoFiles, CgoFiles, CFiles, CXXFiles, MFiles, HFiles, FFiles, SFiles []string
+	SwigFiles, SwigCXXFiles, SysoFiles, EmbedFiles                      []string
+}
+
+// depsKeyParts returns the import paths and the names and contents of the
+// files of the packages outside of the standard library that pkgs depend
+// on for the platform pl, directly or not, including pkgs themselves.
+// The packages are listed the way buildProg builds the coverage program,
+// so they resolve to the copies in its vendor directory.
+func depsKeyParts(pkgs []string, pl platform) ([][]byte, error) {
+	if len(pkgs) == 0 {
+		return nil, nil
+	}
+	gopath, err := filepath.Abs(*workspace)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"list", "-deps", "-json"}
+	for _, path := range pkgs {
+		// Import paths on the command line aren't looked up in
+		// the vendor directory.
+		args = append(args, "./vendor/"+path)
+	}
+	cmd := exec.Command("go", args...)
+	cmd.Dir = filepath.Join(gopath, "src/cover")
+	cmd.Env = append(append(os.Environ(), "GOPATH="+gopath, "GO111MODULE=off"), pl.env()...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing the dependencies for %s: %v\n%s", pl, err, stderr.Bytes())
+	}
+	var parts [][]byte
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var p listedPkg
+		if err := dec.Decode(&p); err != nil {
+			return nil, fmt.Errorf("listing the dependencies for %s: %v", pl, err)
+		}
+		if p.Standard {
+			continue
+		}
+		parts = append(parts, []byte(p.ImportPath))
+		for _, list := range [][]string{p.GoFiles, p.CgoFiles, p.CFiles, p.CXXFiles, p.MFiles, p.HFiles, p.FFiles, p.SFiles,
+			p.SwigFiles, p.SwigCXXFiles, p.SysoFiles, p.EmbedFiles} {
+			for _, name := range list {
+				filename := filepath.Join(p.Dir, name)
+				code, err := ioutil.ReadFile(filename)
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, []byte(filename), code)
+			}
+		}
+	}
+	return parts, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCoverResultsKey(t *testing.T) {
+	tmp := t.TempDir()
+	defer func(old string) { *workspace = old }(*workspace)
+	*workspace = filepath.Join(tmp, "ws")
+	defer func(old string) { *coverMode = old }(*coverMode)
+	*coverMode = "count"
+
+	vendor := filepath.Join(*workspace, "src/cover/vendor")
+	tmpl := filepath.Join(tmp, "tmpl/main.go")
+	pFile := filepath.Join(vendor, "p/p.go")
+	qFile := filepath.Join(vendor, "q/q.go")
+	writeFiles(t, tmp, map[string]string{
+		"tmpl/main.go":               "package main\n",
+		"ws/src/cover/vendor/p/p.go": "package p\n\nimport _ \"q\"\n",
+		"ws/src/cover/vendor/q/q.go": "package q\n",
+	})
+	covers := []CoverFile{{"p", "p", pFile, coverVarPrefix + "0"}}
+	key := func(pl platform) string {
+		k, err := coverResultsKey([]string{tmpl}, []string{"p"}, covers, pl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	linux := platform{"linux", "amd64"}
+	base := key(linux)
+	if k := key(linux); k != base {
+		t.Errorf("key of the same inputs changed: %s, %s", base, k)
+	}
+	if k := key(platform{"windows", "amd64"}); k == base {
+		t.Errorf("key doesn't depend on the platform")
+	}
+
+	*coverMode = "set"
+	if k := key(linux); k == base {
+		t.Errorf("key doesn't depend on the cover mode")
+	}
+	*coverMode = "count"
+
+	for _, name := range []string{tmpl, qFile} {
+		old, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, append(old, "// changed\n"...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if k := key(linux); k == base {
+			t.Errorf("key doesn't depend on %s", name)
+		}
+		if err := ioutil.WriteFile(name, old, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if k := key(linux); k != base {
+		t.Errorf("key of the restored inputs changed: %s, %s", base, k)
+	}
+}
+
+func TestCacheCorruptEntry(t *testing.T) {
+	defer func(old string) { *cacheDir = old }(*cacheDir)
+	*cacheDir = t.TempDir()
+
+	key := cacheKey([]byte("results"))
+	cachePut("results", key, []byte("/src/P/P.go\n#3:2,4:5\n"))
+	if b, ok := cacheGet("results", key); !ok || string(b) != "/src/P/P.go\n#3:2,4:5\n" {
+		t.Fatalf("cacheGet = %q, %v; want the stored data", b, ok)
+	}
+
+	filename := cachePath("results", key)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-2] = '6'
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := cacheGet("results", key); ok {
+		t.Errorf("corrupt entry used: %q", b)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := cacheGet("results", key); ok {
+		t.Errorf("truncated entry used: %q", b)
+	}
+}
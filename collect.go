@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+)
+
+// collectCmd implements the collect subcommand: it runs the template
+// and saves the coverage results instead of slicing. With -covdata, the
+// results are read from the coverage data of binaries built by the build
+// subcommand instead; their packages are looked up from the current
+// directory.
+func collectCmd(args []string) error {
+	fs := flag.NewFlagSet("collect", flag.ContinueOnError)
+	out := fs.String("o", "coverage.json", "save the coverage results to `file`")
+	covdata := fs.String("covdata", "", "read the binary coverage data in the comma-separated `directories` instead of running a template")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] collect [collect flags] <template> [arguments...]\n"+
+			"       %s [flags] collect [collect flags] -covdata <directories>\n\nCollect flags:\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *covdata != "" {
+		if fs.NArg() != 0 {
+			fs.Usage()
+			return errUsage
+		}
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		srcDir = wd
+		mode, results, err := covdataResults(*covdata)
+		if err != nil {
+			return err
+		}
+		return writeResults(*out, mode, results)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	progArgs = fs.Args()[1:]
+
+	run, _, err := collectCoverage(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return writeResults(*out, *coverMode, run.results)
+}
+
+// applyCmd implements the apply subcommand: it slices the packages using
+// saved coverage results. The results may come from another machine, so
+// the files are looked up by their packages. Unused objects are pruned
+// only if the templates using the packages are given.
+func applyCmd(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	var tmpls []string
+	fs.Func("tmpl", "`template` determining the usage of the sliced packages (repeatable)", func(s string) error {
+		tmpls = append(tmpls, s)
+		return nil
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] apply [apply flags] <results file>\n\nApply flags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+
+	sr, err := readResults(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if (*minCount > 1 || *topPercent > 0) && sr.Mode == "set" {
+		return fmt.Errorf("-min-count and -top require results collected with -covermode=count or atomic")
+	}
+
+	// Without templates, the packages are looked up the way
+	// collect -covdata does.
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	srcDir = wd
+	var runs []*tmplRun
+	for _, arg := range tmpls {
+		run, err := loadTmplRun(arg)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+	}
+	for _, cr := range sr.Results {
+		if err := locateFile(cr); err != nil {
+			return err
+		}
+	}
+	return applyResults(sr.Results, runs)
+}
+
+// loadTmplRun loads the template tmplArg without running it, so that
+// it only determines the usage of the sliced packages.
+func loadTmplRun(tmplArg string) (*tmplRun, error) {
+	tp, err := loadTmplPkg(tmplArg)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := tp.SliceFunc()
+	if err != nil {
+		return nil, err
+	}
+	run := &tmplRun{tp: tp, fn: fn}
+	for _, path := range tp.ImportPaths() {
+		if path != fn.ParamPkg() {
+			run.pkgs = append(run.pkgs, path)
+		}
+	}
+	srcDir = tp.Dir
+	return run, nil
+}
+
+// locateFile points the filename of cr to the file of its package on
+// this machine, in case the results were collected elsewhere.
+func locateFile(cr *CoverResult) error {
+	if cr.Package == "" {
+		return nil
+	}
+	p, err := build.Import(cr.Package, srcDir, build.FindOnly)
+	if err != nil {
+		return fmt.Errorf("locating %s: %v", cr.Filename, err)
+	}
+	cr.Filename = filepath.Join(p.Dir, filepath.Base(cr.Filename))
+	return nil
+}
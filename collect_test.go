@@ -0,0 +1,39 @@
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocateFile(t *testing.T) {
+	gopath := t.TempDir()
+	dir := filepath.Join(gopath, "src/slicer/P")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "P.go"), []byte("package P\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { build.Default.GOPATH = old }(build.Default.GOPATH)
+	build.Default.GOPATH = gopath
+	t.Setenv("GO111MODULE", "off")
+
+	cr := &CoverResult{Filename: "/elsewhere/src/slicer/P/P.go", Package: "slicer/P"}
+	if err := locateFile(cr); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "P.go"); cr.Filename != want {
+		t.Errorf("got %s, want %s", cr.Filename, want)
+	}
+
+	cr = &CoverResult{Filename: "/elsewhere/P.go"}
+	if err := locateFile(cr); err != nil || cr.Filename != "/elsewhere/P.go" {
+		t.Errorf("file without package: got %s, %v", cr.Filename, err)
+	}
+	if err := locateFile(&CoverResult{Filename: "Q.go", Package: "slicer/Q"}); err == nil {
+		t.Errorf("expected an error locating a missing package")
+	}
+}
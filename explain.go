@@ -0,0 +1,601 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// explainCmd implements the explain subcommand: it slices the packages
+// imported by the template and reports why the symbol was kept or
+// removed.
+func explainCmd(args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] explain <symbol> <template> [arguments...]\n\n"+
+			"The symbol is given as importpath.Name, importpath.Type.Method or importpath.Type.Field.\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errUsage
+	}
+	progArgs = fs.Args()[2:]
+
+	run, _, err := collectCoverage(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	var pkgs []string
+	for _, r := range run.results {
+		pkgs = append(pkgs, r.Package)
+	}
+	sym, err := parseSymbol(fs.Arg(0), pkgs)
+	if err != nil {
+		return err
+	}
+	if err := applyResults(run.results, []*tmplRun{run}); err != nil {
+		return err
+	}
+	reasons, kept, err := explainSymbol(sym, run.results, keepThreshold(run.results))
+	if err != nil {
+		return err
+	}
+	if kept {
+		fmt.Printf("%s is kept:\n", sym)
+	} else {
+		fmt.Printf("%s is removed:\n", sym)
+	}
+	for _, r := range reasons {
+		fmt.Printf("\t%s\n", r)
+	}
+	return nil
+}
+
+// symbol is a package-level declaration, or a method or a struct field
+// of a declared type.
+type symbol struct {
+	pkg  string // import path
+	typ  string // type of a method or a field
+	name string
+}
+
+func (s symbol) String() string {
+	if s.typ != "" {
+		return s.pkg + "." + s.typ + "." + s.name
+	}
+	return s.pkg + "." + s.name
+}
+
+// parseSymbol parses importpath.Name, importpath.Type.Method or
+// importpath.(*Type).Method, where importpath is the longest of pkgs the
+// symbol starts with. Import paths may contain dots, so the symbol alone
+// doesn't tell where the path ends.
+func parseSymbol(s string, pkgs []string) (symbol, error) {
+	s = strings.NewReplacer("(*", "", ")", "").Replace(s)
+	pkg := ""
+	for _, p := range pkgs {
+		if len(p) > len(pkg) && strings.HasPrefix(s, p+".") {
+			pkg = p
+		}
+	}
+	if pkg == "" {
+		return symbol{}, fmt.Errorf("symbol %q isn't in any of the sliced packages", s)
+	}
+	parts := strings.Split(s[len(pkg)+1:], ".")
+	for _, p := range parts {
+		if p == "" {
+			parts = nil
+		}
+	}
+	switch len(parts) {
+	case 1:
+		return symbol{pkg, "", parts[0]}, nil
+	case 2:
+		return symbol{pkg, parts[0], parts[1]}, nil
+	}
+	return symbol{}, fmt.Errorf("invalid symbol %q: want importpath.Name or importpath.Type.Method", s)
+}
+
+// pruning records what the pruners did to the declarations of the sliced
+// files of a run, by the absolute paths of the files, to explain it.
+var pruning = struct {
+	sync.Mutex
+	files map[string]*prunedDecls
+	usage bool // whether the unused objects were pruned
+}{files: make(map[string]*prunedDecls)}
+
+// prunedDecls are the declarations of a file changed by the pruners. The
+// symbols have no package.
+type prunedDecls struct {
+	emptied  map[symbol]bool // functions StmtPruner removed all the statements of
+	returned map[symbol]bool // functions StmtPruner added a return to
+	unused   map[symbol]bool // declarations ObjPruner removed
+}
+
+func resetPruning() {
+	pruning.Lock()
+	pruning.files = make(map[string]*prunedDecls)
+	pruning.usage = false
+	pruning.Unlock()
+}
+
+// prunedDeclsOf returns the record of the sliced file filename. pruning
+// must be locked.
+func prunedDeclsOf(filename string) *prunedDecls {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	pd := pruning.files[filename]
+	if pd == nil {
+		pd = &prunedDecls{make(map[symbol]bool), make(map[symbol]bool), make(map[symbol]bool)}
+		pruning.files[filename] = pd
+	}
+	return pd
+}
+
+// recordStmtPruning records the functions sp changed in the sliced file
+// filename.
+func recordStmtPruning(filename string, sp *StmtPruner) {
+	pruning.Lock()
+	defer pruning.Unlock()
+	pd := prunedDeclsOf(filename)
+	for _, fd := range sp.emptied {
+		pd.emptied[symbol{"", recvTypeName(fd), fd.Name.Name}] = true
+	}
+	for _, fd := range sp.returned {
+		pd.returned[symbol{"", recvTypeName(fd), fd.Name.Name}] = true
+	}
+}
+
+// recordObjPruning records the symbols of the nodes ObjPruner removed
+// from the sliced file filename, as declared by syms.
+func recordObjPruning(filename string, syms map[ast.Node][]symbol, removed []ast.Node) {
+	pruning.Lock()
+	defer pruning.Unlock()
+	pd := prunedDeclsOf(filename)
+	for _, n := range removed {
+		ast.Inspect(n, func(n ast.Node) bool {
+			for _, sym := range syms[n] {
+				pd.unused[sym] = true
+			}
+			return true
+		})
+	}
+}
+
+// declaredSymbols returns the symbols, without the package, declared by
+// the declarations, specs and struct fields of f.
+func declaredSymbols(f *ast.File) map[ast.Node][]symbol {
+	syms := make(map[ast.Node][]symbol)
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			syms[d] = []symbol{{"", recvTypeName(d), d.Name.Name}}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					syms[s] = []symbol{{"", "", s.Name.Name}}
+					st, ok := s.Type.(*ast.StructType)
+					if !ok {
+						continue
+					}
+					for _, field := range st.Fields.List {
+						for _, id := range field.Names {
+							syms[field] = append(syms[field], symbol{"", s.Name.Name, id.Name})
+						}
+					}
+				case *ast.ValueSpec:
+					for _, id := range s.Names {
+						syms[s] = append(syms[s], symbol{"", "", id.Name})
+					}
+				}
+			}
+		}
+	}
+	return syms
+}
+
+// explainSymbol returns the reasons why the symbol sym was kept or
+// removed by slicing the files of results, keeping the blocks executed at
+// least threshold times.
+func explainSymbol(sym symbol, results []*CoverResult, threshold int) (reasons []string, kept bool, err error) {
+	vendor := filepath.Join(*workspace, "src", dstPackage, "vendor")
+	var cr *CoverResult
+	var decl ast.Node
+	var fset *token.FileSet
+	for _, r := range results {
+		if r.Package != sym.pkg {
+			continue
+		}
+		fset = token.NewFileSet()
+		f, err := parser.ParseFile(fset, r.Filename, nil, 0)
+		if err != nil {
+			return nil, false, err
+		}
+		if decl = findDecl(f, sym); decl != nil {
+			cr = r
+			break
+		}
+	}
+	if cr == nil {
+		return nil, false, fmt.Errorf("no declaration of %s in the sliced packages", sym)
+	}
+	declPos := fset.Position(decl.Pos())
+	reasons = append(reasons, fmt.Sprintf("declared at %s:%d", declPos.Filename, declPos.Line))
+
+	path, err := slicedPath(cr)
+	if err != nil {
+		return nil, false, err
+	}
+	sliced := filepath.Join(vendor, path)
+	pruning.Lock()
+	pd := prunedDeclsOf(sliced)
+	usage := pruning.usage
+	pruning.Unlock()
+	local := symbol{"", sym.typ, sym.name}
+	reasons = append(reasons, coverageReasons(fset, decl, cr, threshold, pd.emptied[local])...)
+	if pd.returned[local] {
+		reasons = append(reasons, "StmtPruner added a bare return at the end of the kept body (return fixing)")
+	}
+
+	if f, err := parser.ParseFile(token.NewFileSet(), sliced, nil, 0); err == nil {
+		kept = findDecl(f, sym) != nil
+	}
+	if !kept {
+		if pd.unused[local] {
+			reasons = append(reasons, "removed by ObjPruner: reported as unused by the unused checker on all the target platforms")
+		} else {
+			reasons = append(reasons, fmt.Sprintf("not in the sliced file %s", sliced))
+		}
+		return reasons, false, nil
+	}
+	if !usage {
+		reasons = append(reasons, "the unused objects weren't pruned: no template determined the usage of the sliced packages")
+		return reasons, true, nil
+	}
+
+	refs, err := referrers(sym)
+	if err != nil {
+		return nil, false, err
+	}
+	reasons = append(reasons, refs...)
+	if len(refs) == 0 {
+		reasons = append(reasons, "not reported by the unused checker, though no kept code refers to it by name; "+
+			"it may implement an interface or be used on another target platform")
+	} else {
+		reasons = append(reasons, "not reported by the unused checker")
+	}
+	return reasons, true, nil
+}
+
+// maxCoveredReasons is how many covered blocks of a function are listed.
+const maxCoveredReasons = 5
+
+// coverageReasons returns how the blocks of the function decl were
+// covered and whether StmtPruner emptied the function. Other declarations
+// have no blocks.
+func coverageReasons(fset *token.FileSet, decl ast.Node, cr *CoverResult, threshold int, emptied bool) []string {
+	fd, ok := decl.(*ast.FuncDecl)
+	if !ok || fd.Body == nil {
+		return []string{"no coverage: only function bodies are covered"}
+	}
+	start, end := fset.Position(fd.Body.Lbrace), fset.Position(fd.Body.Rbrace)
+	within := func(p CoverPos) bool {
+		return (p.Line0 > start.Line || p.Line0 == start.Line && p.Col0 >= start.Column) &&
+			(p.Line1 < end.Line || p.Line1 == end.Line && p.Col1 <= end.Column+1)
+	}
+	var covered []CoverHit
+	blocks := 0
+	for _, hit := range cr.Hits {
+		if within(hit.CoverPos) {
+			blocks++
+			if hit.Count >= threshold {
+				covered = append(covered, hit)
+			}
+		}
+	}
+	for _, rem := range cr.Removes {
+		if within(rem) {
+			blocks++
+		}
+	}
+	switch {
+	case blocks == 0:
+		return []string{"no statements to cover"}
+	case emptied:
+		return []string{fmt.Sprintf("not covered (%d blocks); StmtPruner kept the function with its body emptied "+
+			"so that the interfaces it may implement still compile", blocks)}
+	case len(covered) == 0:
+		return []string{fmt.Sprintf("not covered (%d blocks)", blocks)}
+	}
+	var reasons []string
+	for i, hit := range covered {
+		if i == maxCoveredReasons {
+			reasons = append(reasons, fmt.Sprintf("and %d more covered blocks", len(covered)-i))
+			break
+		}
+		reasons = append(reasons, fmt.Sprintf("covered at %s:%d (%d times)", cr.Filename, hit.Line0, hit.Count))
+	}
+	return reasons
+}
+
+// findDecl returns the declaration of sym in f, or nil.
+func findDecl(f *ast.File, sym symbol) ast.Node {
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Name.Name == sym.name && recvTypeName(d) == sym.typ {
+				return d
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if sym.typ == "" && s.Name.Name == sym.name {
+						return s
+					}
+					st, ok := s.Type.(*ast.StructType)
+					if !ok || s.Name.Name != sym.typ {
+						continue
+					}
+					for _, field := range st.Fields.List {
+						for _, id := range field.Names {
+							if id.Name == sym.name {
+								return field
+							}
+						}
+					}
+				case *ast.ValueSpec:
+					for _, id := range s.Names {
+						if sym.typ == "" && id.Name == sym.name {
+							return s
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// recvTypeName returns the name of the receiver type of the method fd,
+// or "" if fd isn't a method.
+func recvTypeName(fd *ast.FuncDecl) string {
+	if fd.Recv == nil || len(fd.Recv.List) == 0 {
+		return ""
+	}
+	typ := fd.Recv.List[0].Type
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+	if id, ok := typ.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// keptDecl is a package-level declaration kept in the sliced program.
+type keptDecl struct {
+	kind string
+	sym  symbol
+	node ast.Node // a *ast.FuncDecl or a spec of a *ast.GenDecl
+	file *ast.File
+	fset *token.FileSet
+}
+
+// keptDecls returns the declarations of the sliced program in the
+// workspace, except for the imports.
+func keptDecls() ([]keptDecl, error) {
+	root := filepath.Join(*workspace, "src", dstPackage)
+	var files []string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && strings.HasSuffix(p, ".go") {
+			files = append(files, p)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	vendor := filepath.Join(root, "vendor") + string(filepath.Separator)
+	var decls []keptDecl
+	for _, filename := range files {
+		pkg := "main"
+		if strings.HasPrefix(filename, vendor) {
+			pkg = filepath.ToSlash(filepath.Dir(filename[len(vendor):]))
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, filename, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				kind, sym := "function", symbol{pkg, "", d.Name.Name}
+				if typ := recvTypeName(d); typ != "" {
+					kind, sym = "method", symbol{pkg, typ, d.Name.Name}
+				}
+				decls = append(decls, keptDecl{kind, sym, d, f, fset})
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						decls = append(decls, keptDecl{"type", symbol{pkg, "", s.Name.Name}, s, f, fset})
+					case *ast.ValueSpec:
+						decls = append(decls, keptDecl{d.Tok.String(), symbol{pkg, "", s.Names[0].Name}, s, f, fset})
+					}
+				}
+			}
+		}
+	}
+	return decls, nil
+}
+
+// referrers returns where the kept code in the workspace refers to sym.
+// Referrers are followed in turn, indented, up to a root keeping them:
+// the template, the slice function included, or a covered statement of
+// a sliced function. References are found by the names only, so methods
+// and fields of other types with the same name are reported too.
+func referrers(sym symbol) ([]string, error) {
+	decls, err := keptDecls()
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	listed := map[symbol]bool{sym: true}
+	var follow func(sym symbol, depth int)
+	follow = func(sym symbol, depth int) {
+		indent := strings.Repeat("  ", depth)
+		n := len(refs)
+		for _, d := range decls {
+			if d.sym == sym {
+				continue
+			}
+			p := findRef(d.file, d.node, d.sym.pkg, sym)
+			if !p.IsValid() {
+				continue
+			}
+			by := refName(d, p)
+			pos := d.fset.Position(p)
+			ref := fmt.Sprintf("%sreferenced by kept %s %s at %s:%d", indent, d.kind, by, pos.Filename, pos.Line)
+			fd, isFunc := d.node.(*ast.FuncDecl)
+			switch {
+			case by.pkg == "main":
+				refs = append(refs, ref+", in the template")
+			case isFunc && fd.Body != nil && p > fd.Body.Lbrace && p < fd.Body.Rbrace:
+				// The uncovered statements were removed.
+				refs = append(refs, ref+", in a covered statement")
+			case listed[by]:
+				refs = append(refs, ref+", listed above")
+			default:
+				listed[by] = true
+				refs = append(refs, ref)
+				follow(by, depth+1)
+			}
+		}
+		if len(refs) == n && depth > 0 {
+			refs = append(refs, indent+"not referenced by any kept code")
+		}
+	}
+	follow(sym, 0)
+	return refs, nil
+}
+
+// refName returns the symbol of the declaration d referring to sym at p.
+// A value spec with a value for every name refers by the name of the
+// value containing p.
+func refName(d keptDecl, p token.Pos) symbol {
+	vs, ok := d.node.(*ast.ValueSpec)
+	if !ok || len(vs.Values) != len(vs.Names) {
+		return d.sym
+	}
+	for i, v := range vs.Values {
+		if p >= v.Pos() && p < v.End() {
+			return symbol{d.sym.pkg, "", vs.Names[i].Name}
+		}
+	}
+	return d.sym
+}
+
+// findRef returns the position of the first reference to sym in decl, a
+// function declaration or a spec of the file f of the package pkg, or
+// token.NoPos.
+func findRef(f *ast.File, decl ast.Node, pkg string, sym symbol) token.Pos {
+	// The local name of the package of sym in f.
+	local := ""
+	for _, im := range f.Imports {
+		if p, err := strconv.Unquote(im.Path.Value); err == nil && p == sym.pkg {
+			local = path.Base(p)
+			if im.Name != nil {
+				local = im.Name.Name
+			}
+		}
+	}
+	var recv *ast.FieldList
+	if fd, ok := decl.(*ast.FuncDecl); ok {
+		recv = fd.Recv
+	}
+	sels := make(map[*ast.Ident]bool)
+	ref := token.NoPos
+	ast.Inspect(decl, func(n ast.Node) bool {
+		if ref.IsValid() || n == recv && recv != nil {
+			// A method doesn't keep its receiver type.
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			sels[n.Sel] = true
+			if n.Sel.Name != sym.name {
+				break
+			}
+			if x, ok := n.X.(*ast.Ident); sym.typ != "" || ok && x.Name == local && x.Obj == nil {
+				ref = n.Sel.Pos()
+			}
+		case *ast.Ident:
+			// Idents resolved by the parser are local to the file; of
+			// those, only the package-level ones may be sym.
+			if pkg != sym.pkg || sym.typ != "" || sels[n] || n.Name != sym.name || isDeclName(decl, n) {
+				break
+			}
+			if n.Obj == nil || isTopLevel(f, n.Obj.Decl) {
+				ref = n.Pos()
+			}
+		}
+		return true
+	})
+	return ref
+}
+
+// isTopLevel reports whether the object declaration d, as in ast.Object,
+// is a package-level declaration of f.
+func isTopLevel(f *ast.File, d interface{}) bool {
+	for _, decl := range f.Decls {
+		switch dd := decl.(type) {
+		case *ast.FuncDecl:
+			if d == dd {
+				return true
+			}
+		case *ast.GenDecl:
+			for _, spec := range dd.Specs {
+				if d == spec {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isDeclName reports whether id is a name declared by decl, a function
+// declaration or a spec.
+func isDeclName(decl ast.Node, id *ast.Ident) bool {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		return d.Name == id
+	case *ast.TypeSpec:
+		return d.Name == id
+	case *ast.ValueSpec:
+		for _, name := range d.Names {
+			if name == id {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSymbol(t *testing.T) {
+	pkgs := []string{"fmt", "example.com/m/lib", "example.com/m", "gopkg.in/yaml.v2"}
+	for s, want := range map[string]symbol{
+		"fmt.Println":                 {"fmt", "", "Println"},
+		"example.com/m/lib.T.M":       {"example.com/m/lib", "T", "M"},
+		"example.com/m/lib.(*T).M":    {"example.com/m/lib", "T", "M"},
+		"example.com/m.T":             {"example.com/m", "", "T"},
+		"gopkg.in/yaml.v2.Marshal":    {"gopkg.in/yaml.v2", "", "Marshal"},
+		"gopkg.in/yaml.v2.Node.Kind":  {"gopkg.in/yaml.v2", "Node", "Kind"},
+		"example.com/m/lib":           {},
+		"example.com/m/lib.T..M":      {},
+		"example.com/m/lib.T.Field.X": {},
+		"example.com/other.F":         {},
+	} {
+		got, err := parseSymbol(s, pkgs)
+		if (err != nil) != (want == symbol{}) || got != want {
+			t.Errorf("parseSymbol(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	defer func(old string) { *workspace = old }(*workspace)
+	*workspace = t.TempDir()
+	root := filepath.Join(*workspace, "src", dstPackage)
+	writeFiles(t, root, map[string]string{
+		"main.go": `package main
+
+import l "lib"
+
+func Slice() {
+	var t l.T
+	t.M()
+}
+
+func Other(F int) { _ = F; _ = l.W }
+`,
+		"vendor/lib/a.go": `package lib
+
+type T struct{}
+
+func (T) M() { F() }
+
+func (T) F() {}
+`,
+		"vendor/lib/b.go": `package lib
+
+func F() { F() }
+
+var (
+	a = 1
+	V = F
+)
+
+var W, X = V, a
+`,
+	})
+
+	for _, tt := range []struct {
+		sym  symbol
+		want []string
+	}{
+		{symbol{"lib", "", "F"}, []string{
+			"referenced by kept method lib.T.M at " + filepath.Join(root, "vendor/lib/a.go") + ":5, in a covered statement",
+			"referenced by kept var lib.V at " + filepath.Join(root, "vendor/lib/b.go") + ":7",
+			"  referenced by kept var lib.W at " + filepath.Join(root, "vendor/lib/b.go") + ":10",
+			"    referenced by kept function main.Other at " + filepath.Join(root, "main.go") + ":10, in the template",
+		}},
+		{symbol{"lib", "", "a"}, []string{
+			"referenced by kept var lib.X at " + filepath.Join(root, "vendor/lib/b.go") + ":10",
+			"  not referenced by any kept code",
+		}},
+		{symbol{"lib", "", "T"}, []string{
+			"referenced by kept function main.Slice at " + filepath.Join(root, "main.go") + ":6, in the template",
+		}},
+		{symbol{"lib", "T", "M"}, []string{
+			"referenced by kept function main.Slice at " + filepath.Join(root, "main.go") + ":7, in the template",
+		}},
+	} {
+		got, err := referrers(tt.sym)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("referrers(%v) = %q, want %q", tt.sym, got, tt.want)
+		}
+	}
+}
+
+func TestRecordPruning(t *testing.T) {
+	defer resetPruning()
+	resetPruning()
+	src := "package p\n\ntype T struct {\n\tA, B int\n\tC    int\n}\n\nfunc F(x int) int {\n\tif x > 0 {\n\t\treturn x\n\t}\n\tx++\n\treturn x\n}\n\nfunc G() int {\n\treturn 1\n}\n"
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "p.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := func(s string) Uncovered {
+		pos := strings.Index(src, s)
+		return Uncovered{pos, pos + len(s) + 1, 0}
+	}
+	sp := NewStmtPruner(fset, []Uncovered{block("x++\n\treturn x"), block("return 1")}, 1)
+	sp.Update(f)
+	recordStmtPruning("p.go", sp)
+
+	syms := declaredSymbols(f)
+	op := NewObjPruner(fset, []Unused{{pos: strings.Index(src, "C    int")}, {pos: strings.Index(src, "G() int")}})
+	op.Update(f)
+	recordObjPruning("p.go", syms, op.removed)
+
+	pruning.Lock()
+	pd := prunedDeclsOf("p.go")
+	pruning.Unlock()
+	want := &prunedDecls{
+		emptied:  map[symbol]bool{{"", "", "G"}: true},
+		returned: map[symbol]bool{{"", "", "F"}: true, {"", "", "G"}: true},
+		unused:   map[symbol]bool{{"", "T", "C"}: true, {"", "", "G"}: true},
+	}
+	if !reflect.DeepEqual(pd, want) {
+		t.Errorf("got %+v, want %+v", pd, want)
+	}
+}
@@ -1,31 +1,24 @@
 package main
 
 import (
+	"fmt"
 	"go/ast"
 	"go/parser"
-	"go/printer"
 	"go/token"
-	"log"
-	"os"
 )
 
-func fix(filename string, offsets []int) {
+func fix(filename string, offsets []int) error {
 	fset := token.NewFileSet()
-	fileAST, err := parser.ParseFile(fset, filename, nil, 0)
+	fileAST, err := parser.ParseFile(fset, filename, nil, parser.ParseComments)
 	if err != nil {
-		log.Fatal("Parsing file %s: %v", filename, err)
+		return fmt.Errorf("parsing file %s: %v", filename, err)
 	}
 	fx := &Fixer{fset, offsets, make(map[*ast.Object]bool)}
 	fx.Update(fileAST)
+	keepDirectives(fileAST)
+	fileStatsOf(filename).fixes++
 
-	f, err := os.Create(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-	if err := printer.Fprint(f, fset, fileAST); err != nil {
-		log.Fatal(err)
-	}
+	return writeSliced(filename, fset, fileAST)
 }
 
 type Fixer struct {
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+)
+
+// writeInplace writes the sliced files over the originals in dir, a copy
+// or a git worktree of the module (or repository) the originals come
+// from, at their real paths. Files the slicing emptied are deleted. Files
+// the copy doesn't have, or has in another version than the one that was
+// sliced, are left alone, as are the originals themselves.
+func writeInplace(dir string, results []*CoverResult, copied map[string]*nonGoPkg) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	vendor := filepath.Join(*workspace, "src", dstPackage, "vendor")
+	for _, cr := range results {
+		dst, err := inplacePath(dir, cr.Filename)
+		if err != nil {
+			return err
+		}
+		if dst == "" {
+			continue
+		}
+		if h, err := fileHash(dst); err != nil || cr.Hash != "" && h != cr.Hash {
+			Verbosef("Skipping %s: not a copy of %s", dst, cr.Filename)
+			continue
+		}
+		sliced := filepath.Join(vendor, filepath.FromSlash(cr.Package), filepath.Base(cr.Filename))
+		if err := replaceFile(dst, sliced, cr.Filename); err != nil {
+			return err
+		}
+	}
+	for pkgDir, ng := range copied {
+		for _, name := range ng.files {
+			src := filepath.Join(ng.srcDir, filepath.FromSlash(name))
+			dst, err := inplacePath(dir, src)
+			if err != nil {
+				return err
+			}
+			if dst == "" {
+				continue
+			}
+			if _, err := os.Stat(dst); err != nil {
+				continue
+			}
+			if err := replaceFile(dst, filepath.Join(pkgDir, filepath.FromSlash(name)), src); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inplacePath returns the path of the file filename in dir, a copy of the
+// module or repository of the file. It returns "" if the file isn't in
+// a module or a repository.
+func inplacePath(dir, filename string) (string, error) {
+	root := moduleRoot(filepath.Dir(filename))
+	if root == "" {
+		Verbosef("Skipping %s: not in a module or a repository", filename)
+		return "", nil
+	}
+	if root == dir {
+		return "", fmt.Errorf("%s is the original of %s, not a copy", dir, filename)
+	}
+	rel, err := filepath.Rel(root, filename)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// moduleRoot returns the nearest directory containing dir with a go.mod
+// file or, failing that, the root of the git repository containing dir.
+func moduleRoot(dir string) string {
+	for _, marker := range []string{"go.mod", ".git"} {
+		for d := dir; ; d = filepath.Dir(d) {
+			if _, err := os.Stat(filepath.Join(d, marker)); err == nil {
+				return d
+			}
+			if filepath.Dir(d) == d {
+				break
+			}
+		}
+	}
+	return ""
+}
+
+// replaceFile replaces dst with the sliced version of the file orig. It
+// removes dst if the slicing emptied the file: if the sliced version
+// doesn't exist or, for Go files, if it lost all the declarations of orig
+// except for the imports.
+func replaceFile(dst, sliced, orig string) error {
+	isGo := filepath.Ext(orig) == ".go"
+	_, err := os.Stat(sliced)
+	switch {
+	case os.IsNotExist(err) && isGo && !hasDecls(orig):
+		// Nothing to slice in the first place.
+		return nil
+	case os.IsNotExist(err), err == nil && isGo && !hasDecls(sliced) && hasDecls(orig):
+		Verbosef("Removing %s", dst)
+		return os.Remove(dst)
+	case err != nil:
+		return err
+	}
+	return copyFile(dst, sliced)
+}
+
+func hasDecls(filename string) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), filename, nil, 0)
+	if err != nil {
+		return true
+	}
+	for _, decl := range f.Decls {
+		if gd, ok := decl.(*ast.GenDecl); !ok || gd.Tok != token.IMPORT {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteInplace(t *testing.T) {
+	tmp := t.TempDir()
+	orig := map[string]string{
+		"go.mod":     "module example.com/m\n",
+		"p/p.go":     "package p\n\nfunc F() {}\n\nfunc G() {}\n",
+		"p/dead.go":  "package p\n\nimport \"fmt\"\n\nfunc H() { fmt.Println() }\n",
+		"p/gone.go":  "package p\n\nfunc I() {}\n",
+		"p/doc.go":   "// Package p.\npackage p\n",
+		"p/data.txt": "data",
+	}
+	origDir := filepath.Join(tmp, "orig")
+	copyDir := filepath.Join(tmp, "copy")
+	writeFiles(t, origDir, orig)
+	writeFiles(t, copyDir, orig)
+	writeFiles(t, copyDir, map[string]string{"p/p.go": "package p\n\n// Changed in the copy.\nfunc F() {}\n"})
+
+	defer func(old string) { *workspace = old }(*workspace)
+	*workspace = filepath.Join(tmp, "ws")
+	vendor := filepath.Join(*workspace, "src", dstPackage, "vendor/example.com/m/p")
+	writeFiles(t, vendor, map[string]string{
+		"p.go":    "package p\n\nfunc F() {}\n",
+		"dead.go": "package p\n\nimport _ \"fmt\"\n",
+	})
+
+	// A file outside any module or repository comes first and is
+	// skipped.
+	loose := filepath.Join(tmp, "loose/l.go")
+	writeFiles(t, tmp, map[string]string{"loose/l.go": "package l\n"})
+	results := []*CoverResult{{Filename: loose, Package: "loose"}}
+	for _, name := range []string{"p.go", "dead.go", "gone.go", "doc.go"} {
+		filename := filepath.Join(origDir, "p", name)
+		h, err := fileHash(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, &CoverResult{Filename: filename, Package: "example.com/m/p", Hash: h})
+	}
+	copied := map[string]*nonGoPkg{vendor: {srcDir: filepath.Join(origDir, "p"), files: []string{"data.txt"}}}
+	if err := writeInplace(copyDir, results, copied); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, exists := range map[string]bool{"p.go": true, "dead.go": false, "gone.go": false, "doc.go": true, "data.txt": false} {
+		if _, err := os.Stat(filepath.Join(copyDir, "p", name)); (err == nil) != exists {
+			t.Errorf("%s: exists = %v, want %v", name, err == nil, exists)
+		}
+	}
+	// The copy of p.go differs from the sliced original, so it's kept.
+	if b, _ := ioutil.ReadFile(filepath.Join(copyDir, "p/p.go")); string(b) == "package p\n\nfunc F() {}\n" {
+		t.Errorf("p.go of another version overwritten")
+	}
+	for name, src := range orig {
+		if b, err := ioutil.ReadFile(filepath.Join(origDir, name)); err != nil || string(b) != src {
+			t.Errorf("original %s modified", name)
+		}
+	}
+
+	if err := writeInplace(origDir, results, nil); err == nil {
+		t.Errorf("expected an error writing over the originals")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// lineMaps are the line maps of the sliced files written so far, by the
+// absolute paths of the files. They are only recorded with -linemap.
+var lineMaps = struct {
+	sync.Mutex
+	m map[string]*lineMap
+}{m: make(map[string]*lineMap)}
+
+// lineMap maps the lines of a sliced file to the lines of its original.
+type lineMap struct {
+	orig  string
+	lines []int // by line of the sliced file; 0 if not known
+}
+
+// lineRange says that the lines of a sliced file from Line on come from
+// the lines of the original from Orig on, up to the next range.
+type lineRange struct {
+	Line int `json:"line"`
+	Orig int `json:"orig"`
+}
+
+// savedLineMap is the JSON form of a line map.
+type savedLineMap struct {
+	Original string      `json:"original"`
+	Ranges   []lineRange `json:"ranges"`
+}
+
+func resetLineMaps() {
+	lineMaps.Lock()
+	lineMaps.m = make(map[string]*lineMap)
+	lineMaps.Unlock()
+}
+
+// writeSliced writes the file f, parsed from a sliced file or from its
+// original, to filename. With -linemap or -markers it records from which
+// lines of the original the written lines come.
+func writeSliced(filename string, fset *token.FileSet, f *ast.File) error {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		return err
+	}
+	if *lineMapMode != "" || *markers {
+		if err := recordLineMap(filename, fset, f, buf.Bytes()); err != nil {
+			Verbosef("No line map for %s: %v", filename, err)
+		}
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// recordLineMap records the line map of the file f printed as src to
+// filename. The printer keeps the nodes of f, so the nodes of src parsed
+// again correspond to them one by one; each line of src is mapped to the
+// line of the node the line starts with.
+func recordLineMap(filename string, fset *token.FileSet, f *ast.File, src []byte) (err error) {
+	filename, err = filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	lineMaps.Lock()
+	defer lineMaps.Unlock()
+	defer func() {
+		// The map of the previous version of the file is wrong now.
+		if err != nil {
+			delete(lineMaps.m, filename)
+		}
+	}()
+
+	pfset := token.NewFileSet()
+	printed, err := parser.ParseFile(pfset, filename, src, 0)
+	if err != nil {
+		return err
+	}
+	from, to := lineMapNodes(f), lineMapNodes(printed)
+	if len(from) != len(to) {
+		return fmt.Errorf("printed file differs from its syntax tree")
+	}
+	lm := &lineMap{lines: make([]int, pfset.File(printed.Pos()).LineCount())}
+	for i, n := range to {
+		if reflect.TypeOf(n) != reflect.TypeOf(from[i]) {
+			return fmt.Errorf("printed file differs from its syntax tree")
+		}
+		if !from[i].Pos().IsValid() {
+			// Added by slicing.
+			continue
+		}
+		pos := pfset.PositionFor(n.Pos(), false)
+		if lm.lines[pos.Line-1] != 0 || !startsLine(src, pos.Offset) {
+			continue
+		}
+		orig, line := origLine(fset.PositionFor(from[i].Pos(), false))
+		if lm.orig == "" {
+			lm.orig = orig
+		}
+		if orig == lm.orig {
+			lm.lines[pos.Line-1] = line
+		}
+	}
+	if lm.orig == "" {
+		return fmt.Errorf("no line comes from the original")
+	}
+	lineMaps.m[filename] = lm
+	return nil
+}
+
+// lineMapNodes returns the nodes of f in depth-first order, except for
+// the comments, which the slicing changes, and the imports, before which
+// no //line directive may go as it would end up in a cgo preamble.
+func lineMapNodes(f *ast.File) []ast.Node {
+	var nodes []ast.Node
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case nil, *ast.CommentGroup, *ast.Comment:
+			return false
+		case *ast.GenDecl:
+			if n.Tok == token.IMPORT {
+				return false
+			}
+		}
+		nodes = append(nodes, n)
+		return true
+	})
+	return nodes
+}
+
+// startsLine reports whether only blanks precede offset on its line.
+func startsLine(src []byte, offset int) bool {
+	for i := offset - 1; i >= 0 && src[i] != '\n'; i-- {
+		if src[i] != ' ' && src[i] != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// origLine returns the original file and line of the position pos,
+// following the line map of the file of pos if it's a sliced file. Lines
+// not known follow the preceding line. lineMaps must be locked.
+func origLine(pos token.Position) (string, int) {
+	filename, err := filepath.Abs(pos.Filename)
+	if err != nil {
+		filename = pos.Filename
+	}
+	lm := lineMaps.m[filename]
+	if lm == nil {
+		return filename, pos.Line
+	}
+	for i := pos.Line - 1; i >= 0; i-- {
+		if i < len(lm.lines) && lm.lines[i] != 0 {
+			return lm.orig, lm.lines[i] + pos.Line - 1 - i
+		}
+	}
+	return lm.orig, pos.Line
+}
+
+// ranges returns the line ranges of lm. Lines not known follow the
+// preceding line.
+func (lm *lineMap) ranges() []lineRange {
+	var ranges []lineRange
+	next := 1
+	for i, line := range lm.lines {
+		if i == 0 && line == 0 {
+			line = 1
+		}
+		if line != 0 && (line != next || ranges == nil) {
+			ranges = append(ranges, lineRange{i + 1, line})
+			next = line
+		}
+		next++
+	}
+	return ranges
+}
+
+// writeLineMaps writes the recorded line maps of the sliced files left
+// after the pruning: as //line directives into the files for the mode
+// directives, or next to each file as filename.map.json for the mode
+// json.
+func writeLineMaps() error {
+	lineMaps.Lock()
+	defer lineMaps.Unlock()
+	files := make([]string, 0, len(lineMaps.m))
+	for filename := range lineMaps.m {
+		files = append(files, filename)
+	}
+	sort.Strings(files)
+	for _, filename := range files {
+		lm := lineMaps.m[filename]
+		src, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		switch *lineMapMode {
+		case "directives":
+			src = insertLineDirectives(src, lm.orig, lm.ranges())
+			err = ioutil.WriteFile(filename, src, 0644)
+		case "json":
+			var b []byte
+			b, err = json.MarshalIndent(savedLineMap{lm.orig, lm.ranges()}, "", "\t")
+			if err == nil {
+				err = ioutil.WriteFile(filename+".map.json", append(b, '\n'), 0644)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertLineDirectives inserts a //line directive for each of the ranges
+// into src, a file sliced from orig. The first range needs a directive
+// only if it doesn't start at the first line of orig.
+func insertLineDirectives(src []byte, orig string, ranges []lineRange) []byte {
+	var buf bytes.Buffer
+	lines := bytes.SplitAfter(src, []byte("\n"))
+	for i, l := range lines {
+		if len(ranges) > 0 && ranges[0].Line == i+1 {
+			if i > 0 || ranges[0].Orig != 1 {
+				fmt.Fprintf(&buf, "//line %s:%d\n", orig, ranges[0].Orig)
+			}
+			ranges = ranges[1:]
+		}
+		buf.Write(l)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const lineMapSrc = `// Copyright notice.
+
+package p
+
+func F(x int) int {
+	if x > 0 {
+		x++
+		x++
+	}
+	return x * 2
+}
+
+func G() {}
+
+// H is pruned as unused.
+func H() {}
+
+func I() {
+	println("I")
+}
+`
+
+func TestLineMap(t *testing.T) {
+	defer func(old string) { *lineMapMode = old }(*lineMapMode)
+	tmp := t.TempDir()
+	orig := filepath.Join(tmp, "orig.go")
+	if err := ioutil.WriteFile(orig, []byte(lineMapSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The sliced file, pruned in two passes.
+	sliced := filepath.Join(tmp, "vendor", "p", "orig.go")
+	slice := func(mode string) {
+		*lineMapMode = mode
+		resetLineMaps()
+		cr := &CoverResult{Filename: orig, Package: "p", Removes: []CoverPos{{6, 12, 9, 3}}}
+		if err := sliceFile(tmp, cr, 1); err != nil {
+			t.Fatal(err)
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, sliced, nil, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Decls = append(f.Decls[:2], f.Decls[3:]...)
+		keepDirectives(f)
+		if err := writeSliced(sliced, fset, f); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeLineMaps(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slice("directives")
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, sliced, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int)
+	ast.Inspect(f, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			got[n.Name.Name] = fset.Position(n.Pos()).Line
+		case *ast.ReturnStmt, *ast.ExprStmt:
+			got[reflect.TypeOf(n).String()] = fset.Position(n.Pos()).Line
+		}
+		if fset.Position(n.Pos()).Filename != orig {
+			t.Errorf("%T: position in %s, want %s", n, fset.Position(n.Pos()).Filename, orig)
+		}
+		return true
+	})
+	want := map[string]int{"F": 5, "*ast.ReturnStmt": 10, "G": 13, "I": 18, "*ast.ExprStmt": 19}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines %v, want %v", got, want)
+	}
+
+	slice("json")
+	b, err := ioutil.ReadFile(sliced + ".map.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lm savedLineMap
+	if err := json.Unmarshal(b, &lm); err != nil {
+		t.Fatal(err)
+	}
+	wantMap := savedLineMap{orig, []lineRange{{1, 3}, {5, 10}, {10, 18}}}
+	if !reflect.DeepEqual(lm, wantMap) {
+		t.Errorf("got line map %+v, want %+v", lm, wantMap)
+	}
+}
@@ -3,30 +3,57 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
-	"go/ast"
 	"go/build"
-	"go/parser"
-	"go/printer"
-	"go/token"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 var (
-	workspace = flag.String("w", "./slicer-ws", "`workspace` directory; it will be truncated")
-	verbose   = flag.Bool("v", false, "verbose mode")
+	workspace     = flag.String("w", "", "`workspace` directory; it must be empty or a previous workspace (default: a temporary directory)")
+	verbose       = flag.Bool("v", false, "verbose mode")
+	jobs          = flag.Int("j", runtime.NumCPU(), "number of files processed in parallel")
+	watchMode     = flag.Bool("watch", false, "slice again whenever the template or a covered file changes")
+	keepWorkspace = flag.Bool("keep-workspace", false, "don't remove the temporary workspace")
+	cacheDir      = flag.String("cache", defaultCacheDir(), "`directory` for caching instrumented files and coverage results; empty disables caching")
+	progStdin     = flag.String("stdin", "", "`file` to feed to the standard input of the slicing run")
+	timeout       = flag.Duration("timeout", 0, "stop the slicing run after `duration` and use the coverage collected so far")
+	memLimit      = flag.Int("memlimit", 0, "limit the data segment of the slicing run to `MB` megabytes (Linux only)")
+	cpuLimit      = flag.Duration("cpulimit", 0, "limit the CPU time of the slicing run to `duration` (Linux only)")
+	coverMode     = flag.String("covermode", "set", "coverage `mode`: set, count or atomic")
+	race          = flag.Bool("race", false, "build the coverage program with the race detector; requires -covermode=atomic")
+	minCount      = flag.Int("min-count", 1, "remove blocks executed fewer than `n` times; requires -covermode=count or atomic")
+	topPercent    = flag.Float64("top", 0, "keep only the `percent` of executed blocks with the highest counts; requires -covermode=count or atomic")
+	outDir        = flag.String("out", "", "also write the sliced packages and the usage program to `directory` as a Go module")
+	inplace       = flag.String("inplace", "", "also write the sliced files over the originals in `directory`, a copy or a git worktree of their module")
+	lineMapMode   = flag.String("linemap", "", "map the lines of the sliced files to the original lines: `mode` directives inserts //line directives, json writes a file.go.map.json next to each file")
+	markers       = flag.Bool("markers", false, "leave a comment saying which lines were removed in place of removed code")
+	binarySize    = flag.Bool("binary-size", false, "compare the binary sizes of the usage program built against the original and the sliced packages")
+	sizeReport    = flag.Int("size-report", 0, "report the binary size difference of the original and the sliced program by package and by the `n` symbols changing most; implies -binary-size")
+	progEnv       envList
+	platforms     platformList
 
-	srcDir string
+	srcDir   string
+	progArgs []string // arguments of the slicing run
 )
 
+func init() {
+	flag.Var(&progEnv, "env", "set `NAME=value` in the environment of the slicing run (repeatable)")
+	flag.Var(&platforms, "platforms", "comma-separated `GOOS/GOARCH` list the sliced packages must build for (default: the host platform)")
+}
+
 const (
 	coverVarPrefix = "SliceCover_"
 	dstPackage     = "sliced"
@@ -37,7 +64,7 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 
-	if flag.NArg() != 1 {
+	if flag.NArg() < 1 {
 		flag.Usage()
 		os.Exit(2)
 	}
@@ -47,138 +74,518 @@ func main() {
 		flag.Usage()
 		os.Exit(2)
 	}
+	switch *coverMode {
+	case "set", "count", "atomic":
+	default:
+		log.Fatalf("Unknown cover mode %q", *coverMode)
+	}
+	if *race && *coverMode != "atomic" {
+		log.Fatal("-race requires -covermode=atomic")
+	}
+	// The results applied by apply carry their own cover mode.
+	if (*minCount > 1 || *topPercent > 0) && *coverMode == "set" && tmplFile != "apply" {
+		log.Fatal("-min-count and -top require -covermode=count or atomic")
+	}
+	if *minCount < 1 {
+		log.Fatal("-min-count must be at least 1")
+	}
+	if *topPercent < 0 || *topPercent > 100 {
+		log.Fatal("-top must be a percentage between 0 and 100")
+	}
+	if *sizeReport < 0 {
+		log.Fatal("-size-report must not be negative")
+	}
+	switch *lineMapMode {
+	case "", "directives", "json":
+	default:
+		log.Fatalf("Unknown line map mode %q", *lineMapMode)
+	}
 
-	if err := os.RemoveAll(*workspace); err != nil {
+	cleanup, err := setupWorkspace()
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case tmplFile == "merge":
+		err = mergeCmd(flag.Args()[1:])
+	case tmplFile == "collect":
+		err = collectCmd(flag.Args()[1:])
+	case tmplFile == "apply":
+		err = applyCmd(flag.Args()[1:])
+	case tmplFile == "build":
+		err = buildCmd(flag.Args()[1:])
+	case tmplFile == "explain":
+		err = explainCmd(flag.Args()[1:])
+	case *watchMode:
+		progArgs = flag.Args()[1:]
+		err = watch(tmplFile, cleanup)
+	default:
+		progArgs = flag.Args()[1:]
+		_, err = slice(tmplFile)
+	}
+	cleanup()
+	switch err {
+	case nil, flag.ErrHelp:
+	case errUsage:
+		os.Exit(2)
+	default:
 		log.Fatal(err)
 	}
-	slice(tmplFile)
+}
+
+// errUsage is returned by a subcommand given invalid arguments, once its
+// usage is printed.
+var errUsage = errors.New("invalid usage")
+
+// parseFlags parses the flags of a subcommand from args. The flag set,
+// which must continue on errors, prints the usage for invalid flags.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil && err != flag.ErrHelp {
+		return errUsage
+	}
+	return err
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s <template>\n\nFlags:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <template file, directory or package> [arguments...]\n"+
+		"       %s [flags] merge [merge flags] <template or results file>...\n"+
+		"       %s [flags] collect [collect flags] <template> [arguments...]\n"+
+		"       %s [flags] collect [collect flags] -covdata <directories>\n"+
+		"       %s [flags] apply [apply flags] <results file>\n"+
+		"       %s [flags] build [build flags] <main package>\n"+
+		"       %s [flags] explain <symbol> <template> [arguments...]\n\n"+
+		"The arguments are passed to the slicing run. A template named like a subcommand is\n"+
+		"given as ./name.\n\nFlags:\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 	flag.PrintDefaults()
 }
 
-func slice(tmplFile string) {
-	fset := token.NewFileSet()
-	pf, err := parser.ParseFile(fset, tmplFile, nil, 0)
+// slice slices the packages imported by the template tmplArg. Besides
+// an error, it returns the files the result depends on: the files of
+// the template and the source files of the covered packages.
+func slice(tmplArg string) (inputs []string, err error) {
+	run, inputs, err := collectCoverage(tmplArg)
 	if err != nil {
-		log.Fatal(err)
+		return inputs, err
 	}
+	return inputs, applyResults(run.results, []*tmplRun{run})
+}
 
-	imports := make(Imports, 0, len(pf.Imports))
-	var covers []CoverFile
-	srcDir = filepath.Dir(tmplFile)
-	for _, im := range pf.Imports {
-		path, err := strconv.Unquote(im.Path.Value)
+// tmplRun is a run of a template that collected coverage.
+type tmplRun struct {
+	tp      *TmplPkg
+	fn      SliceFunc
+	pkgs    []string // import paths of the covered packages
+	results []*CoverResult
+}
+
+// collectCoverage instruments the packages imported by the template
+// tmplArg, runs the template and returns the coverage results. Besides
+// an error, it returns the files the results depend on.
+func collectCoverage(tmplArg string) (run *tmplRun, inputs []string, err error) {
+	tp, err := loadTmplPkg(tmplArg)
+	if err != nil {
+		return nil, []string{tmplArg}, err
+	}
+	inputs = tp.Inputs()
+	tmplInputs := inputs
+	if *progStdin != "" {
+		inputs = append(inputs, *progStdin)
+	}
+
+	sliceFunc, err := tp.SliceFunc()
+	if err != nil {
+		return nil, inputs, err
+	}
+
+	srcDir = tp.Dir
+	var pkgs []string
+	for _, path := range tp.ImportPaths() {
+		if path != sliceFunc.ParamPkg() {
+			// The package of the parameter is only needed
+			// to call the slice function, not worth slicing.
+			pkgs = append(pkgs, path)
+		}
+	}
+
+	// The coverage of a file is the union of the coverage of all the
+	// platforms building it. Files only the platforms whose coverage
+	// couldn't be collected build are kept whole.
+	var sets [][]*CoverResult
+	platforms := make(map[string]int) // number of platforms building a file
+	failed := make(map[platform][]CoverFile)
+	var failedOrder []platform
+	for _, pl := range targetPlatforms() {
+		covers, results, err := collectPlatform(tp, sliceFunc, pkgs, tmplInputs, pl)
+		for _, cf := range covers {
+			if platforms[cf.Name] == 0 {
+				inputs = append(inputs, cf.Name)
+			}
+			platforms[cf.Name]++
+		}
 		if err != nil {
-			log.Panic("invalid quoted string returned by parser")
+			if pl == hostPlatform || covers == nil {
+				return nil, inputs, err
+			}
+			failed[pl] = covers
+			failedOrder = append(failedOrder, pl)
+			log.Printf("Collecting the coverage for %s: %v", pl, err)
+			continue
 		}
-		name := ""
-		if im.Name != nil {
-			name = im.Name.Name
+		sets = append(sets, results)
+	}
+	var whole []*CoverResult
+	for _, pl := range failedOrder {
+		for _, cf := range failed[pl] {
+			if platforms[cf.Name] > 1 {
+				return nil, inputs, fmt.Errorf("no coverage for %s of %s, which other platforms build too; "+
+					"run the collect subcommand on %s and the merge subcommand on the results instead", pl, cf.Name, pl)
+			}
+			whole = append(whole, &CoverResult{Filename: cf.Name, Package: cf.Path})
+		}
+		Verbosef("Keeping the files only %s builds whole", pl)
+	}
+
+	var results []*CoverResult
+	switch len(sets) {
+	case 0:
+	case 1:
+		results = sets[0]
+	default:
+		if results, err = mergeResults(sets, false); err != nil {
+			return nil, inputs, err
+		}
+	}
+	results = append(results, whole...)
+	for _, cr := range results {
+		if cr.Hash, err = fileHash(cr.Filename); err != nil {
+			return nil, inputs, err
 		}
-		imports.Append(name, path)
-		p, err := build.Import(path, srcDir, 0)
+	}
+	return &tmplRun{tp, sliceFunc, pkgs, results}, inputs, nil
+}
+
+// collectPlatform instruments the files of the packages pkgs built for
+// the platform pl and runs the template tp on the platform. It returns
+// the instrumented files even if the run fails, unless the packages
+// can't be built for the platform at all.
+func collectPlatform(tp *TmplPkg, sliceFunc SliceFunc, pkgs, tmplInputs []string, pl platform) (covers []CoverFile, results []*CoverResult, err error) {
+	// Leave nothing from the previous run in the coverage program.
+	if err := os.RemoveAll(filepath.Join(*workspace, "src/cover")); err != nil {
+		return nil, nil, err
+	}
+
+	var imports Imports
+	var coverDsts []string
+	ctx := pl.context()
+	for _, path := range pkgs {
+		p, err := ctx.Import(path, srcDir, 0)
 		if err != nil {
-			log.Fatalf("Importing package: %v", err)
+			return nil, nil, fmt.Errorf("importing package for %s: %v", pl, err)
 		}
+		imports.Append(p.Name, path)
 		newDir := filepath.Join(*workspace, "src/cover/vendor", path)
 		if err := os.MkdirAll(newDir, 0755); err != nil {
-			log.Fatal(err)
+			return nil, nil, err
+		}
+		// The C and assembly files are needed to build the program.
+		ng, err := nonGoFiles(p.Dir, []build.Context{ctx})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := copyPkgFiles(newDir, p.Dir, ng.files); err != nil {
+			return nil, nil, err
 		}
-		for i, file := range p.GoFiles {
+		for i, file := range append(p.GoFiles[:len(p.GoFiles):len(p.GoFiles)], p.CgoFiles...) {
 			filePath := filepath.Join(p.Dir, file)
-			covers = append(covers, CoverFile{p.Name, filePath, coverVarPrefix + strconv.Itoa(i)})
-			err := genCoverFile(i, filepath.Join(newDir, file), filePath)
-			if err != nil {
-				log.Fatalf("Generating cover file %s: %v", filePath, err)
-			}
+			covers = append(covers, CoverFile{p.Name, path, filePath, coverVarPrefix + strconv.Itoa(i)})
+			coverDsts = append(coverDsts, filepath.Join(newDir, file))
 		}
 	}
 
-	var sliceFunc *ast.FuncDecl
-	for _, decl := range pf.Decls {
-		fd, ok := decl.(*ast.FuncDecl)
-		if !ok || !strings.HasPrefix(fd.Name.Name, "Slice") ||
-			fd.Recv != nil || fd.Type.Params.List != nil || fd.Type.Results != nil {
-			continue
-		}
-		sliceFunc = fd
+	if err := instrumentFiles(covers, coverDsts); err != nil {
+		return covers, nil, err
+	}
 
-		// TODO: Add support for multiple functions.
-		break
+	var key string
+	if *cacheDir != "" {
+		// The key is only an optimisation; failing to compute it
+		// just means the results aren't cached.
+		if key, err = coverResultsKey(tmplInputs, pkgs, covers, pl); err != nil {
+			Verbosef("Not caching the coverage results for %s: %v", pl, err)
+			key = ""
+		}
+	}
+	var out []byte
+	ok := false
+	if key != "" {
+		out, ok = cacheGet("results", key)
+	}
+	if ok {
+		Verbosef("Using cached coverage results for %s", pl)
+	} else {
+		var partial bool
+		out, partial, err = runCoverProg(tp, imports, sliceFunc, covers, pl)
+		if err != nil {
+			return covers, nil, err
+		}
+		if !partial && key != "" {
+			cachePut("results", key, out)
+		}
 	}
 
-	var buf bytes.Buffer
-	if err := printer.Fprint(&buf, fset, sliceFunc); err != nil {
-		log.Fatalf("Printing slice func %s: %v", sliceFunc.Name.Name, err)
+	results, err = parseCoverOutput(bytes.NewReader(out))
+	if err != nil {
+		return covers, nil, fmt.Errorf("parsing the output of the coverage program: %v", err)
+	}
+	for _, cr := range results {
+		for _, cf := range covers {
+			if cf.Name == cr.Filename {
+				cr.Package = cf.Path
+			}
+		}
 	}
+	return covers, results, nil
+}
 
-	coverProg := filepath.Join(*workspace, "src/cover", "cover.go")
-	err = WriteTmplToFile(coverProg, TemplateStruct{
-		Imports: imports.CopyWithFmt().String(),
-		Func:    buf.String(),
-		Name:    sliceFunc.Name.Name,
-		Files:   covers,
+// applyResults slices the files of results into the workspace. The
+// objects the sliced packages no longer use are pruned only if runs are
+// all the runs the results come from; otherwise the usage isn't known.
+func applyResults(results []*CoverResult, runs []*tmplRun) error {
+	threshold := keepThreshold(results)
+	resetLineMaps()
+	resetStats()
+	resetPruning()
+	dstDir := filepath.Join(*workspace, "src", dstPackage)
+	err := forEach(len(results), func(i int) error {
+		if err := sliceFile(dstDir, results[i], threshold); err != nil {
+			return fmt.Errorf("slicing %s: %v", results[i].Filename, err)
+		}
+		return nil
 	})
 	if err != nil {
-		log.Fatal("Writing template %s: %v", coverProg, err)
+		return err
 	}
+	copied, err := copyNonGoFiles(dstDir, results)
+	if err != nil {
+		return err
+	}
+
+	if len(runs) == 0 {
+		log.Print("No template to determine the usage of the sliced packages; unused objects are kept")
+	} else if err := pruneUsage(runs, copied); err != nil {
+		return err
+	} else if *binarySize || *sizeReport > 0 {
+		if err := compareSizes(results, runs); err != nil {
+			log.Printf("Comparing the binary sizes: %v", err)
+		}
+	}
+	if err := countSlicedLines(); err != nil {
+		return err
+	}
+	if *lineMapMode != "" {
+		if err := writeLineMaps(); err != nil {
+			return err
+		}
+	}
+	if *inplace != "" {
+		if err := writeInplace(*inplace, results, copied); err != nil {
+			return err
+		}
+	}
+	if *outDir != "" {
+		if err := writeOutModule(*outDir, results); err != nil {
+			return err
+		}
+	}
+	printStats(os.Stderr)
+	return nil
+}
+
+// keepThreshold returns how many times a block of results must have been
+// executed to be kept.
+func keepThreshold(results []*CoverResult) int {
+	threshold := *minCount
+	if *topPercent > 0 {
+		if top := topCount(results, *topPercent); top > threshold {
+			threshold = top
+		}
+		Verbosef("Keeping blocks executed at least %d times", threshold)
+	}
+	return threshold
+}
 
-	var stdout bytes.Buffer
-	cmd := exec.Command("go", "run", coverProg)
+// pruneUsage writes the usage programs of the runs to the workspace and
+// prunes the objects of the sliced packages they don't use.
+func pruneUsage(runs []*tmplRun, copied map[string]*nonGoPkg) error {
+	var packages []string
+	seen := make(map[string]bool)
+	for i, run := range runs {
+		for _, path := range run.pkgs {
+			if !seen[path] {
+				seen[path] = true
+				packages = append(packages, path)
+			}
+		}
+		// Every template gets its own usage program; they all
+		// share the vendored sliced packages.
+		prog := progPath(dstPackage, i, len(runs))
+		dir := filepath.Join(*workspace, "src", filepath.FromSlash(prog))
+		if _, err := run.tp.WriteProgram(dir, genMainData(run.tp, run.fn, nil, nil, "")); err != nil {
+			return err
+		}
+		packages = append(packages, prog)
+	}
+	if err := pruneUnusedObjs(*workspace, packages); err != nil {
+		return err
+	}
+	pruning.Lock()
+	pruning.usage = true
+	pruning.Unlock()
+	return pruneNonGo(copied)
+}
+
+// progPath returns the import path of the usage program of the i-th of
+// n runs in the program root.
+func progPath(root string, i, n int) string {
+	if n > 1 {
+		return root + "/prog" + strconv.Itoa(i)
+	}
+	return root
+}
+
+// instrumentFiles writes the instrumented covers to coverDsts.
+func instrumentFiles(covers []CoverFile, coverDsts []string) error {
+	return forEach(len(covers), func(i int) error {
+		cf := covers[i]
+		if err := genCoverFile(cf.Var, coverDsts[i], cf.Name); err != nil {
+			return fmt.Errorf("generating cover file %s: %v", cf.Name, err)
+		}
+		return nil
+	})
+}
+
+// runCoverProg runs the slice function against the instrumented files on
+// the platform pl and returns the output of the coverage program. The
+// output is partial if the run was stopped for exceeding a limit.
+func runCoverProg(tp *TmplPkg, imports Imports, sliceFunc SliceFunc, covers []CoverFile, pl platform) (out []byte, partial bool, err error) {
 	gopath, err := filepath.Abs(*workspace)
 	if err != nil {
-		log.Fatalf("Executing coverage program: %v", err)
+		return nil, false, err
 	}
-	cmd.Env = []string{"GOPATH=" + gopath}
-	cmd.Stdout = &stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatal(err)
+	outFile := filepath.Join(gopath, "cover.out")
+	if err := os.Remove(outFile); err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	coverDir := filepath.Join(gopath, "src/cover")
+	files, err := tp.WriteProgram(coverDir, genMainData(tp, sliceFunc, imports, covers, outFile))
+	if err != nil {
+		return nil, false, err
 	}
 
-	clearFiles, err := parseCoverOutput(&stdout)
+	bin, err := buildProg(coverDir, files, pl)
 	if err != nil {
-		log.Fatalf("Parsing the output of the coverage program: %v", err)
+		return nil, false, err
 	}
+	return runCoverBin(bin, coverDir, outFile, pl)
+}
 
-	dstDir := filepath.Join(*workspace, "src", dstPackage)
-	for _, cr := range clearFiles {
-		if err := sliceFile(dstDir, cr); err != nil {
-			log.Fatalf("Slicing %s: %v", cr.Filename, err)
+// genMainData returns the data for the generated main function calling
+// sliceFunc. If covers isn't empty, the function also writes the coverage
+// data of the files to outFile; the packages of the files are in imports.
+func genMainData(tp *TmplPkg, sliceFunc SliceFunc, imports Imports, covers []CoverFile, outFile string) TemplateStruct {
+	var paths []string
+	if len(covers) > 0 {
+		paths = append(paths, genMainImports...)
+		if *coverMode == "atomic" {
+			paths = append(paths, "sync/atomic")
 		}
 	}
+	switch sliceFunc.Param {
+	case "*testing.T":
+		paths = append(paths, "testing", "flag")
+	case "*testing.B":
+		paths = append(paths, "testing")
+	case "context.Context":
+		paths = append(paths, "context")
+	}
 
-	usageProg := filepath.Join(dstDir, "main.go")
-	err = WriteTmplToFile(usageProg, TemplateStruct{
-		Imports: imports.String(),
-		Func:    buf.String(),
-		Name:    sliceFunc.Name.Name,
-	})
-	if err != nil {
-		log.Fatalf("Writing template %s: %v", usageProg, err)
+	// The generated main function lives in its own file, but its imports
+	// still mustn't collide with the package-level names of the template.
+	taken := tp.Idents()
+	for _, name := range genMainLocals {
+		taken[name] = true
+	}
+	var progImports Imports
+	if len(covers) > 0 {
+		progImports = append(progImports, imports...)
+	}
+	for _, path := range paths {
+		if progImports.Name(path) == "" {
+			progImports.Append(filepath.Base(path), path)
+		}
+	}
+	progImports = progImports.WithAliases(taken)
+	progCovers := make([]CoverFile, len(covers))
+	for i, cf := range covers {
+		cf.Package = progImports.Name(cf.Path)
+		progCovers[i] = cf
 	}
 
-	pruneUnusedObjs(*workspace, append(imports.Paths(), dstPackage))
+	ts := TemplateStruct{
+		Fmt:     progImports.Name("fmt"),
+		Os:      progImports.Name("os"),
+		Signal:  progImports.Name("os/signal"),
+		Syscall: progImports.Name("syscall"),
+		Testing: progImports.Name("testing"),
+		Flag:    progImports.Name("flag"),
+		Context: progImports.Name("context"),
+		Atomic:  progImports.Name("sync/atomic"),
+		SIGXCPU: *cpuLimit > 0,
+		Out:     outFile,
+		Name:    sliceFunc.Name,
+		Param:   sliceFunc.Param,
+		Files:   progCovers,
+	}
+	if len(progImports) > 0 {
+		ts.Imports = progImports.String()
+	}
+	if sliceFunc.Param == "context.Context" {
+		ts.Deadline = int64(*timeout)
+	}
+	return ts
 }
 
 type CoverResult struct {
-	Filename string
-	Removes  []CoverPos
+	Filename string     `json:"filename"`
+	Package  string     `json:"package,omitempty"` // import path of the package of the file
+	Hash     string     `json:"hash,omitempty"`    // hash of the file the coverage was collected for
+	Removes  []CoverPos `json:"removes"`
+	Hits     []CoverHit `json:"hits"` // executed blocks
 }
 
 type CoverPos struct {
-	Line0, Col0 int
-	Line1, Col1 int
+	Line0 int `json:"line0"`
+	Col0  int `json:"col0"`
+	Line1 int `json:"line1"`
+	Col1  int `json:"col1"`
 }
 
 func (r CoverPos) String() string {
 	return fmt.Sprintf("%d:%d,%d:%d", r.Line0, r.Col0, r.Line1, r.Col1)
 }
 
-var rangeRx = regexp.MustCompile(`^#(\d+):(\d+),(\d+):(\d+)$`)
+// CoverHit is a block executed Count times. In the set mode,
+// the count is always 1.
+type CoverHit struct {
+	CoverPos
+	Count int `json:"count"`
+}
+
+var (
+	rangeRx = regexp.MustCompile(`^#(\d+):(\d+),(\d+):(\d+)$`)
+	hitRx   = regexp.MustCompile(`^\+(\d+):(\d+),(\d+):(\d+) (\d+)$`)
+)
 
 func parseCoverOutput(r io.Reader) ([]*CoverResult, error) {
 	var results []*CoverResult
@@ -186,7 +593,7 @@ func parseCoverOutput(r io.Reader) ([]*CoverResult, error) {
 	var cur *CoverResult
 	for sc.Scan() {
 		l := sc.Text()
-		if !strings.HasPrefix(l, "#") {
+		if !strings.HasPrefix(l, "#") && !strings.HasPrefix(l, "+") {
 			if cur != nil {
 				results = append(results, cur)
 			}
@@ -202,15 +609,50 @@ func parseCoverOutput(r io.Reader) ([]*CoverResult, error) {
 			})
 			continue
 		}
+		if m := hitRx.FindStringSubmatch(l); m != nil {
+			cur.Hits = append(cur.Hits, CoverHit{
+				CoverPos: CoverPos{
+					Line0: toInt(m[1]),
+					Col0:  toInt(m[2]),
+					Line1: toInt(m[3]),
+					Col1:  toInt(m[4]),
+				},
+				Count: toInt(m[5]),
+			})
+			continue
+		}
 		return nil, fmt.Errorf("error parsing: %q", l)
 	}
 	if err := sc.Err(); err != nil {
 		return nil, err
 	}
-	results = append(results, cur)
+	if cur != nil {
+		results = append(results, cur)
+	}
 	return results, nil
 }
 
+// topCount returns the lowest count among the percent of executed blocks
+// of all the results with the highest counts. Blocks with the same
+// count are either all kept or all dropped.
+func topCount(results []*CoverResult, percent float64) int {
+	var counts []int
+	for _, cr := range results {
+		for _, hit := range cr.Hits {
+			counts = append(counts, hit.Count)
+		}
+	}
+	if len(counts) == 0 {
+		return 0
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(counts)))
+	n := int(math.Ceil(float64(len(counts)) * percent / 100))
+	if n < 1 {
+		n = 1
+	}
+	return counts[n-1]
+}
+
 func toInt(a string) int {
 	i, err := strconv.Atoi(a)
 	if err != nil {
@@ -219,9 +661,27 @@ func toInt(a string) int {
 	return i
 }
 
-func genCoverFile(key int, dst, src string) error {
-	cmd := exec.Command("go", "tool", "cover", "-mode=set", "-var="+coverVarPrefix+strconv.Itoa(key), "-o", dst, src)
-	return cmd.Run()
+// genCoverFile instruments src and writes the result to dst. Instrumented
+// files are cached by their content, the cover mode and the Go version.
+func genCoverFile(coverVar, dst, src string) error {
+	code, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	key := cacheKey([]byte(goVersion()), []byte(*coverMode), []byte(coverVar), []byte(src), code)
+	if b, ok := cacheGet("cover", key); ok {
+		return ioutil.WriteFile(dst, b, 0644)
+	}
+	cmd := exec.Command("go", "tool", "cover", "-mode="+*coverMode, "-var="+coverVar, "-o", dst, src)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		return err
+	}
+	cachePut("cover", key, b)
+	return nil
 }
 
 func Verbosef(format string, args ...interface{}) {
@@ -3,11 +3,14 @@ package main
 import (
 	"bytes"
 	"flag"
+	"go/ast"
 	"go/build"
-	"io"
+	"go/parser"
+	"go/token"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -56,7 +59,9 @@ func testTmpl(name string, t *testing.T) {
 		t.Fatal(err)
 	}
 	build.Default.GOPATH = gopath
-	slice(tmpl)
+	if _, err := slice(tmpl); err != nil {
+		t.Fatal(err)
+	}
 
 	wantFilename := filepath.Join(testDir, name+".want")
 	want, err := ioutil.ReadFile(wantFilename)
@@ -73,17 +78,247 @@ func testTmpl(name string, t *testing.T) {
 	}
 }
 
-func copyFile(dst, src string) error {
-	df, err := os.Create(dst)
+func TestCheckTemplateDecls(t *testing.T) {
+	tests := []struct {
+		src     string
+		collide bool
+	}{
+		{src: "package main\ntype T int\nfunc init() {}\nfunc Slice() {}\nfunc helper() int { return 6 }"},
+		{src: "package main\nfunc Slice() {}\ntype T int\nfunc (T) main() {}"},
+		{src: "package main\nfunc Slice() {}\nfunc main() {}", collide: true},
+		{src: "package main\nfunc Slice() {}\nvar main = 1", collide: true},
+		{src: "package main\nfunc Slice() {}\ntype main int", collide: true},
+		{src: "package main\nfunc Slice() {}\ntype uint16 int", collide: true},
+	}
+	for _, tt := range tests {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "tmpl.go", tt.src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkTemplateDecls(fset, []*ast.File{f})
+		if tt.collide && err == nil {
+			t.Errorf("%q: expected a collision", tt.src)
+		} else if !tt.collide && err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+		}
+	}
+}
+
+// writeFiles writes the files, mapping slash-separated names relative to
+// dir to their contents, creating the directories as needed.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, src := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadTmplPkg(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go":          "package main\nimport \"strings\"\nfunc helper() string { return strings.ToUpper(\"a\") }\n",
+		"b.go":          "package main\nimport (\n\t\"bytes\"\n\t\"strings\"\n)\nfunc SliceB() { helper(); bytes.NewReader(nil) }\n",
+		"testdata/in":   "input",
+		"b_test.go":     "package main\n",
+		"ignored.txt":   "",
+		"testdata/x/in": "",
+	}
+	writeFiles(t, dir, files)
+
+	tp, err := loadTmplPkg(dir)
 	if err != nil {
-		return err
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(tp.ImportPaths(), " "), "strings bytes"; got != want {
+		t.Errorf("import paths: got %q, want %q", got, want)
+	}
+	if fn, err := tp.SliceFunc(); err != nil || fn != (SliceFunc{"SliceB", ""}) {
+		t.Errorf("slice func: got %v, %v, want SliceB", fn, err)
+	}
+	var inputs []string
+	for _, in := range tp.Inputs() {
+		rel, _ := filepath.Rel(dir, in)
+		inputs = append(inputs, rel)
 	}
-	defer df.Close()
-	sf, err := os.Open(src)
+	if got, want := strings.Join(inputs, " "), "a.go b.go testdata/in testdata/x/in"; got != want {
+		t.Errorf("inputs: got %q, want %q", got, want)
+	}
+
+	single, err := loadTmplPkg(filepath.Join(dir, "a.go"))
 	if err != nil {
-		return err
+		t.Fatal(err)
+	}
+	if got, want := single.Inputs(), []string{filepath.Join(dir, "a.go")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("inputs of a single file: got %q, want %q", got, want)
+	}
+}
+
+func TestImportsWithAliases(t *testing.T) {
+	var imps Imports
+	imps.Append("rand", "math/rand")
+	imps.Append("rand", "crypto/rand")
+	imps.Append("fmt", "fmt")
+	imps.Append("P", "slicer/P")
+	taken := map[string]bool{"fmt": true, "fmt1": true, "i": true}
+
+	got := imps.WithAliases(taken)
+	want := map[string]string{
+		"math/rand":   "rand",
+		"crypto/rand": "rand1",
+		"fmt":         "fmt2",
+		"slicer/P":    "P",
+	}
+	for path, name := range want {
+		if got.Name(path) != name {
+			t.Errorf("%s: got name %q, want %q", path, got.Name(path), name)
+		}
+	}
+	if imps.Name("fmt") != "fmt" {
+		t.Errorf("original imports modified")
+	}
+}
+
+func TestSliceTmpl(t *testing.T) {
+	var imps Imports
+	imps.Append("P", "slicer/P")
+	imps.Append("fmt", "fmt")
+	imps.Append("os", "os")
+	imps.Append("signal", "os/signal")
+	imps.Append("syscall", "syscall")
+	imps.Append("atomic", "sync/atomic")
+	for _, ts := range []TemplateStruct{
+		{Name: "Slice"},
+		{Imports: imps.String(), Testing: "testing", Flag: "flag", Name: "Slice", Param: "*testing.T"},
+		{Imports: imps.String(), Testing: "testing", Name: "Slice", Param: "*testing.B"},
+		{Imports: imps.String(), Context: "ctx1", Name: "Slice", Param: "context.Context"},
+		{Imports: imps.String(), Context: "ctx1", Name: "Slice", Param: "context.Context", Deadline: 1e9},
+		{
+			Imports: imps.String(),
+			Fmt:     "fmt",
+			Os:      "os",
+			Signal:  "signal",
+			Syscall: "syscall",
+			Out:     "/tmp/cover.out",
+			Name:    "Slice",
+			Files:   []CoverFile{{"P", "slicer/P", "/src/P/P.go", "SliceCover_0"}},
+		},
+		{
+			Imports: imps.String(),
+			Fmt:     "fmt",
+			Os:      "os",
+			Signal:  "signal",
+			Syscall: "syscall",
+			Atomic:  "atomic",
+			Out:     "/tmp/cover.out",
+			Name:    "Slice",
+			Files:   []CoverFile{{"P", "slicer/P", "/src/P/P.go", "SliceCover_0"}},
+		},
+		{
+			Imports: imps.String(),
+			Fmt:     "fmt",
+			Os:      "os",
+			Signal:  "signal",
+			Syscall: "syscall",
+			SIGXCPU: true,
+			Out:     "/tmp/cover.out",
+			Name:    "Slice",
+			Files:   []CoverFile{{"P", "slicer/P", "/src/P/P.go", "SliceCover_0"}},
+		},
+	} {
+		var buf bytes.Buffer
+		if err := sliceTmpl.Execute(&buf, ts); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parser.ParseFile(token.NewFileSet(), genMainFile, buf.Bytes(), 0); err != nil {
+			t.Errorf("generated main doesn't parse: %v\n%s", err, buf.Bytes())
+		}
+	}
+}
+
+func TestSliceFuncParams(t *testing.T) {
+	tests := []struct {
+		src   string
+		param string
+		ok    bool
+	}{
+		{"func SliceX() {}", "", true},
+		{"func SliceX(t *testing.T) {}", "*testing.T", true},
+		{"func SliceX(b *testing.B) {}", "*testing.B", true},
+		{"func SliceX(ctx context.Context) {}", "context.Context", true},
+		{"func SliceX(t *tst.T) {}", "*testing.T", true},
+		{"func SliceX(t testing.T) {}", "", false},
+		{"func SliceX(t *testing.M) {}", "", false},
+		{"func SliceX(a, b int) {}", "", false},
+		{"func SliceX() int { return 0 }", "", false},
+	}
+	for _, tt := range tests {
+		src := "package main\nimport (\n\t\"context\"\n\t\"testing\"\n\ttst \"testing\"\n)\n" + tt.src
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "tmpl.go", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tp := &TmplPkg{fset: fset, asts: []*ast.File{f}}
+		fn, err := tp.SliceFunc()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected error value: %v", tt.src, err)
+			continue
+		}
+		if tt.ok && fn.Param != tt.param {
+			t.Errorf("%s: got param %q, want %q", tt.src, fn.Param, tt.param)
+		}
+	}
+}
+
+func TestParseCoverOutput(t *testing.T) {
+	out := "/src/P/P.go\n#3:2,4:5\n+7:1,8:2 42\n/src/P/Q.go\n+1:1,2:2 1\n"
+	results, err := parseCoverOutput(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	p := results[0]
+	if p.Filename != "/src/P/P.go" || len(p.Removes) != 1 || p.Removes[0] != (CoverPos{3, 2, 4, 5}) {
+		t.Errorf("unexpected removes of %s: %v", p.Filename, p.Removes)
+	}
+	if len(p.Hits) != 1 || p.Hits[0] != (CoverHit{CoverPos{7, 1, 8, 2}, 42}) {
+		t.Errorf("unexpected hits of %s: %v", p.Filename, p.Hits)
+	}
+	if q := results[1]; q.Filename != "/src/P/Q.go" || len(q.Removes) != 0 || len(q.Hits) != 1 {
+		t.Errorf("unexpected result for %s: %+v", q.Filename, q)
+	}
+
+	if results, err := parseCoverOutput(strings.NewReader("")); err != nil || len(results) != 0 {
+		t.Errorf("empty output: got %v, %v", results, err)
+	}
+}
+
+func TestTopCount(t *testing.T) {
+	results := []*CoverResult{
+		{Hits: []CoverHit{{Count: 100}, {Count: 5}, {Count: 1}}},
+		{Hits: []CoverHit{{Count: 50}, {Count: 5}}},
+	}
+	tests := []struct {
+		percent float64
+		want    int
+	}{
+		{100, 1},
+		{50, 5}, // 3rd of 5 blocks
+		{40, 50},
+		{1, 100},
+	}
+	for _, tt := range tests {
+		if got := topCount(results, tt.percent); got != tt.want {
+			t.Errorf("top %v%%: got %d, want %d", tt.percent, got, tt.want)
+		}
 	}
-	defer sf.Close()
-	_, err = io.Copy(df, sf)
-	return err
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const markerPrefix = "// slicer: removed "
+
+func isMarker(c string) bool {
+	return strings.HasPrefix(c, markerPrefix)
+}
+
+// markRemoved leaves a comment in f, parsed from src, in place of each
+// run of the removed nodes, saying which lines of the original file were
+// removed. Nodes follow each other in a run if only comments separate
+// them. The markers of earlier slicing passes within the removed nodes
+// are dropped. It must be called after keepDirectives.
+func markRemoved(fset *token.FileSet, f *ast.File, src []byte, removed []ast.Node) {
+	var runs [][2]token.Pos
+	for _, n := range outermost(removed) {
+		if k := len(runs) - 1; k >= 0 && onlyComments(fset, src, runs[k][1], n.Pos()) {
+			runs[k][1] = n.End()
+			continue
+		}
+		runs = append(runs, [2]token.Pos{n.Pos(), n.End()})
+	}
+	if runs == nil {
+		return
+	}
+
+	comments := f.Comments[:0]
+	for _, cg := range f.Comments {
+		within := false
+		for _, r := range runs {
+			if cg.Pos() >= r[0] && cg.End() <= r[1] {
+				within = true
+				break
+			}
+		}
+		if !within {
+			comments = append(comments, cg)
+		}
+	}
+	lineMaps.Lock()
+	for _, r := range runs {
+		orig, line0 := origLine(fset.PositionFor(r[0], false))
+		_, line1 := origLine(fset.PositionFor(r[1], false))
+		base := filepath.Base(orig)
+		text := fmt.Sprintf("%s%d lines (%s:%d-%d)", markerPrefix, line1-line0+1, base, line0, line1)
+		if line0 == line1 {
+			text = fmt.Sprintf("%s1 line (%s:%d)", markerPrefix, base, line0)
+		}
+		comments = append(comments, &ast.CommentGroup{List: []*ast.Comment{{Slash: r[0], Text: text}}})
+	}
+	lineMaps.Unlock()
+	sort.Slice(comments, func(i, j int) bool { return comments[i].Pos() < comments[j].Pos() })
+	f.Comments = comments
+}
+
+// outermost returns the removed nodes not within other removed nodes,
+// ordered by their positions.
+func outermost(removed []ast.Node) []ast.Node {
+	sorted := append([]ast.Node(nil), removed...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Pos() != sorted[j].Pos() {
+			return sorted[i].Pos() < sorted[j].Pos()
+		}
+		return sorted[i].End() > sorted[j].End()
+	})
+	var nodes []ast.Node
+	for _, n := range sorted {
+		if !n.Pos().IsValid() || len(nodes) > 0 && n.End() <= nodes[len(nodes)-1].End() {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// onlyComments reports whether there are only comments between the
+// positions pos and end in src.
+func onlyComments(fset *token.FileSet, src []byte, pos, end token.Pos) bool {
+	off0, off1 := fset.PositionFor(pos, false).Offset, fset.PositionFor(end, false).Offset
+	if off0 > off1 || off1 > len(src) {
+		return false
+	}
+	var s scanner.Scanner
+	file := token.NewFileSet().AddFile("", -1, off1-off0)
+	s.Init(file, src[off0:off1], nil, scanner.ScanComments)
+	for {
+		_, tok, _ := s.Scan()
+		switch tok {
+		case token.EOF:
+			return true
+		case token.COMMENT, token.SEMICOLON:
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const markersSrc = `package p
+
+type T struct {
+	A int
+	B int
+}
+
+func F(x int) int {
+	if x > 0 {
+		x++
+		x++
+	}
+	x--
+	return x
+}
+
+func G(x int) {
+	if x > 0 {
+		println(x)
+	}
+	println()
+}
+`
+
+const markersSliced = `package p
+
+type T struct {
+	A int
+	// slicer: removed 1 line (orig.go:5)
+}
+
+func F(x int) int {
+	// slicer: removed 5 lines (orig.go:9-13)
+
+	return x
+}
+
+// slicer: removed 6 lines (orig.go:17-22)
+`
+
+func TestMarkers(t *testing.T) {
+	defer func(old bool) { *markers = old }(*markers)
+	*markers = true
+	resetLineMaps()
+	tmp := t.TempDir()
+	orig := filepath.Join(tmp, "orig.go")
+	if err := ioutil.WriteFile(orig, []byte(markersSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cr := &CoverResult{Filename: orig, Package: "p", Removes: []CoverPos{
+		{9, 12, 12, 2},
+		{13, 2, 13, 4},
+		{18, 12, 20, 2},
+	}}
+	if err := sliceFile(tmp, cr, 1); err != nil {
+		t.Fatal(err)
+	}
+	sliced := filepath.Join(tmp, "vendor", "p", "orig.go")
+	b, err := ioutil.ReadFile(sliced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "// slicer: removed 3 lines (orig.go:18-20)") {
+		t.Errorf("no marker of the removed if statement in:\n%s", b)
+	}
+
+	// Pruning G removes the marker in it.
+	obj := types.NewVar(token.NoPos, nil, "", nil)
+	us := []Unused{
+		{obj, strings.Index(string(b), "func G") + len("func ")},
+		{obj, strings.Index(string(b), "B\tint")},
+	}
+	if err := pruneFileUnused(sliced, us); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = ioutil.ReadFile(sliced); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != markersSliced {
+		t.Errorf("got:\n%s\nwant:\n%s", b, markersSliced)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// mergeCmd implements the merge subcommand: it slices the packages using
+// the merged coverage results of several runs. Every argument is either
+// a template, which is run to collect the coverage, or a file with saved
+// results (ending in .json).
+func mergeCmd(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	op := fs.String("op", "union", "how to merge the runs: union keeps the blocks any run executed, intersect the blocks all runs executed")
+	out := fs.String("o", "", "also save the merged results to `file`")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] merge [merge flags] <template or results file>...\n\nMerge flags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *op != "union" && *op != "intersect" {
+		return fmt.Errorf("unknown merge operation %q", *op)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	// Without templates, the packages of the saved results are looked
+	// up the way apply does.
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	srcDir = wd
+	var sets [][]*CoverResult
+	var runs []*tmplRun
+	allTemplates := true
+	for _, arg := range fs.Args() {
+		if strings.HasSuffix(arg, ".json") {
+			sr, err := readResults(arg)
+			if err != nil {
+				return err
+			}
+			if sr.Mode != *coverMode {
+				return fmt.Errorf("%s: collected with -covermode=%s, not %s", arg, sr.Mode, *coverMode)
+			}
+			for _, cr := range sr.Results {
+				if err := locateFile(cr); err != nil {
+					return fmt.Errorf("%s: %v", arg, err)
+				}
+			}
+			sets = append(sets, sr.Results)
+			allTemplates = false
+			continue
+		}
+		Verbosef("Collecting coverage of %s", arg)
+		run, _, err := collectCoverage(arg)
+		if err != nil {
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+		sets = append(sets, run.results)
+		runs = append(runs, run)
+	}
+
+	results, err := mergeResults(sets, *op == "intersect")
+	if err != nil {
+		return err
+	}
+	if *out != "" {
+		if err := writeResults(*out, *coverMode, results); err != nil {
+			return err
+		}
+	}
+	if !allTemplates {
+		// The usage of the packages by the runs of the saved
+		// results isn't known.
+		runs = nil
+	}
+	return applyResults(results, runs)
+}
+
+// mergeResults merges the coverage results of several runs. In a union,
+// a block is kept if any of the runs executed it and its count is the sum
+// of the counts. In an intersection, a block is kept only if all the runs
+// executed it and its count is the lowest of the counts; a file missing
+// from the results of a run wasn't needed by the run at all.
+func mergeResults(runs [][]*CoverResult, intersect bool) ([]*CoverResult, error) {
+	type block struct {
+		runs       int // number of runs executing the block
+		sum, least int
+	}
+	type file struct {
+		cr     *CoverResult
+		blocks map[CoverPos]*block
+		order  []CoverPos
+	}
+	files := make(map[string]*file)
+	var order []string
+	for _, results := range runs {
+		for _, cr := range results {
+			f := files[cr.Filename]
+			if f == nil {
+				f = &file{
+					cr:     &CoverResult{Filename: cr.Filename, Package: cr.Package, Hash: cr.Hash},
+					blocks: make(map[CoverPos]*block),
+				}
+				files[cr.Filename] = f
+				order = append(order, cr.Filename)
+			} else if f.cr.Hash != cr.Hash {
+				return nil, fmt.Errorf("%s: coverage collected for different versions of the file", cr.Filename)
+			}
+			add := func(pos CoverPos, count int) {
+				b := f.blocks[pos]
+				if b == nil {
+					b = new(block)
+					f.blocks[pos] = b
+					f.order = append(f.order, pos)
+				}
+				if count == 0 {
+					return
+				}
+				if b.runs == 0 || count < b.least {
+					b.least = count
+				}
+				b.runs++
+				b.sum += count
+			}
+			for _, pos := range cr.Removes {
+				add(pos, 0)
+			}
+			for _, hit := range cr.Hits {
+				add(hit.CoverPos, hit.Count)
+			}
+		}
+	}
+
+	merged := make([]*CoverResult, 0, len(order))
+	for _, name := range order {
+		f := files[name]
+		for _, pos := range f.order {
+			b := f.blocks[pos]
+			switch {
+			case intersect && b.runs == len(runs):
+				f.cr.Hits = append(f.cr.Hits, CoverHit{pos, b.least})
+			case !intersect && b.runs > 0:
+				f.cr.Hits = append(f.cr.Hits, CoverHit{pos, b.sum})
+			default:
+				f.cr.Removes = append(f.cr.Removes, pos)
+			}
+		}
+		merged = append(merged, f.cr)
+	}
+	return merged, nil
+}
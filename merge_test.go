@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeResults(t *testing.T) {
+	a, b, c := CoverPos{1, 1, 2, 2}, CoverPos{3, 1, 4, 2}, CoverPos{5, 1, 6, 2}
+	runs := [][]*CoverResult{
+		{
+			{Filename: "P.go", Hash: "h", Removes: []CoverPos{c}, Hits: []CoverHit{{a, 2}, {b, 5}}},
+			{Filename: "Q.go", Hits: []CoverHit{{a, 1}}},
+		},
+		{
+			{Filename: "P.go", Hash: "h", Removes: []CoverPos{b}, Hits: []CoverHit{{a, 3}, {c, 1}}},
+		},
+	}
+
+	union, err := mergeResults(runs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*CoverResult{
+		{Filename: "P.go", Hash: "h", Hits: []CoverHit{{c, 1}, {a, 5}, {b, 5}}},
+		{Filename: "Q.go", Hits: []CoverHit{{a, 1}}},
+	}
+	if !reflect.DeepEqual(union, want) {
+		t.Errorf("union: got %+v, want %+v", union, want)
+	}
+
+	inter, err := mergeResults(runs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []*CoverResult{
+		{Filename: "P.go", Hash: "h", Removes: []CoverPos{c, b}, Hits: []CoverHit{{a, 2}}},
+		{Filename: "Q.go", Removes: []CoverPos{a}},
+	}
+	if !reflect.DeepEqual(inter, want) {
+		t.Errorf("intersection: got %+v, want %+v", inter, want)
+	}
+
+	runs[1][0].Hash = "other"
+	if _, err := mergeResults(runs, false); err == nil {
+		t.Errorf("expected an error merging different versions of a file")
+	}
+}
+
+func TestSavedResults(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "results.json")
+	results := []*CoverResult{{
+		Filename: "/src/P/P.go",
+		Package:  "slicer/P",
+		Hash:     "h",
+		Removes:  []CoverPos{{3, 2, 4, 5}},
+		Hits:     []CoverHit{{CoverPos{7, 1, 8, 2}, 42}},
+	}}
+	if err := writeResults(filename, "count", results); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := readResults(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Mode != "count" || !reflect.DeepEqual(sr.Results, results) {
+		t.Errorf("got %+v, want mode count and %+v", sr, results)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// isDirective reports whether the comment c is a directive for the go
+// command or the compiler rather than a plain comment.
+func isDirective(c string) bool {
+	for _, prefix := range []string{"//go:", "// +build ", "//export ", "//line "} {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepDirectives drops the comments of f, except for the build constraints,
+// the directives of the remaining declarations and the preamble of cgo,
+// which the sliced code still needs, and the markers of removed code. It
+// must be called after the declarations of f were pruned.
+func keepDirectives(f *ast.File) {
+	docs := make(map[*ast.CommentGroup]bool)
+	preambles := make(map[*ast.CommentGroup]bool)
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.GenDecl:
+			docs[d.Doc] = true
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.ValueSpec:
+					docs[s.Doc] = true
+				case *ast.TypeSpec:
+					docs[s.Doc] = true
+				case *ast.ImportSpec:
+					if s.Path.Value == `"C"` {
+						preambles[s.Doc] = true
+						if len(d.Specs) == 1 {
+							preambles[d.Doc] = true
+						}
+					}
+				}
+			}
+		case *ast.FuncDecl:
+			docs[d.Doc] = true
+		}
+	}
+	var comments []*ast.CommentGroup
+	for _, cg := range f.Comments {
+		if preambles[cg] {
+			comments = append(comments, cg)
+			continue
+		}
+		directives := docs[cg] || cg.Pos() < f.Package
+		var list []*ast.Comment
+		for _, c := range cg.List {
+			if directives && isDirective(c.Text) || isMarker(c.Text) {
+				list = append(list, c)
+			}
+		}
+		if list != nil {
+			comments = append(comments, &ast.CommentGroup{List: list})
+		}
+	}
+	f.Comments = comments
+}
+
+// nonGoPkg are the files of a package other than the Go files.
+type nonGoPkg struct {
+	srcDir string   // directory of the original package
+	files  []string // relative to the package directory
+	sfiles []string // assembly files among the files
+	embeds []string // embedded files among the files
+}
+
+// nonGoFiles returns the files of the package in dir other than the Go
+// files needed to build the package in any of the contexts.
+func nonGoFiles(dir string, ctxs []build.Context) (*nonGoPkg, error) {
+	files := make(map[string]bool)
+	sfiles := make(map[string]bool)
+	embeds := make(map[string]bool)
+	for _, ctx := range ctxs {
+		p, err := ctx.ImportDir(dir, 0)
+		if _, ok := err.(*build.NoGoError); ok {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, list := range [][]string{p.CFiles, p.CXXFiles, p.MFiles, p.HFiles, p.FFiles, p.SwigFiles, p.SwigCXXFiles, p.SysoFiles} {
+			for _, name := range list {
+				files[name] = true
+			}
+		}
+		for _, name := range p.SFiles {
+			files[name] = true
+			sfiles[name] = true
+		}
+		for _, pattern := range p.EmbedPatterns {
+			matches, err := embedFiles(dir, pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range matches {
+				files[name] = true
+				embeds[name] = true
+			}
+		}
+	}
+	return &nonGoPkg{dir, sortedKeys(files), sortedKeys(sfiles), sortedKeys(embeds)}, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// embedFiles returns the files in dir matched by the //go:embed pattern,
+// relative to dir. Files in matched directories starting with . or _
+// are only included with the all: prefix.
+func embedFiles(dir, pattern string) ([]string, error) {
+	all := strings.HasPrefix(pattern, "all:")
+	pattern = strings.TrimPrefix(pattern, "all:")
+	matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, m := range matches {
+		err := filepath.Walk(m, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if name := fi.Name(); p != m && !all && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !fi.IsDir() {
+				rel, err := filepath.Rel(dir, p)
+				if err != nil {
+					return err
+				}
+				files = append(files, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// embedMatch reports whether the //go:embed pattern matches the file
+// name, given relative to the package directory, or a directory
+// containing it.
+func embedMatch(pattern, name string) bool {
+	pattern = strings.TrimPrefix(pattern, "all:")
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// copyNonGoFiles copies the files other than the Go files of the packages
+// of results, for any of the target platforms, next to the sliced Go
+// files in the vendor tree in dstDir. It returns the copied files by the
+// directories of the packages in the vendor tree.
+func copyNonGoFiles(dstDir string, results []*CoverResult) (map[string]*nonGoPkg, error) {
+	var ctxs []build.Context
+	for _, pl := range targetPlatforms() {
+		ctxs = append(ctxs, pl.context())
+	}
+	copied := make(map[string]*nonGoPkg)
+	for _, cr := range results {
+		pkgDir := filepath.Join(dstDir, "vendor", filepath.FromSlash(cr.Package))
+		if cr.Package == "" || copied[pkgDir] != nil {
+			continue
+		}
+		srcDir := filepath.Dir(cr.Filename)
+		ng, err := nonGoFiles(srcDir, ctxs)
+		if err != nil {
+			return nil, err
+		}
+		if err := copyPkgFiles(pkgDir, srcDir, ng.files); err != nil {
+			return nil, err
+		}
+		copied[pkgDir] = ng
+	}
+	return copied, nil
+}
+
+// copyPkgFiles copies the files, relative to srcDir, to dstDir.
+func copyPkgFiles(dstDir, srcDir string, files []string) error {
+	for _, name := range files {
+		dst := filepath.Join(dstDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(dst, filepath.Join(srcDir, filepath.FromSlash(name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneNonGo removes the parts of the copied files whose Go declarations
+// were pruned: the embedded files no //go:embed directive matches anymore
+// and the assembly functions without Go declarations.
+func pruneNonGo(copied map[string]*nonGoPkg) error {
+	for dir, ng := range copied {
+		if len(ng.sfiles) == 0 && len(ng.embeds) == 0 {
+			continue
+		}
+		funcs, patterns, err := goDecls(dir)
+		if err != nil {
+			return err
+		}
+		for _, name := range ng.embeds {
+			matched := false
+			for _, pattern := range patterns {
+				if embedMatch(pattern, name) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				Verbosef("Removing embedded file %s", name)
+				if err := os.Remove(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+					return err
+				}
+			}
+		}
+		var sfiles []string
+		for _, name := range ng.sfiles {
+			sfiles = append(sfiles, filepath.Join(dir, name))
+		}
+		if err := pruneAsm(sfiles, funcs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// goDecls returns the names of the functions declared by the Go files in
+// dir and the patterns of their //go:embed directives.
+func goDecls(dir string) (funcs map[string]bool, patterns []string, err error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, nil, err
+	}
+	funcs = make(map[string]bool)
+	for _, name := range names {
+		f, err := parser.ParseFile(token.NewFileSet(), name, nil, parser.ParseComments)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, decl := range f.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv == nil {
+				funcs[fd.Name.Name] = true
+			}
+		}
+		for _, cg := range f.Comments {
+			for _, c := range cg.List {
+				if !strings.HasPrefix(c.Text, "//go:embed ") {
+					continue
+				}
+				for _, p := range strings.Fields(strings.TrimPrefix(c.Text, "//go:embed ")) {
+					if uq, err := strconv.Unquote(p); err == nil {
+						p = uq
+					}
+					patterns = append(patterns, p)
+				}
+			}
+		}
+	}
+	return funcs, patterns, nil
+}
+
+var (
+	asmTextRx = regexp.MustCompile(`^TEXT\s+·(\w+)\(SB\)`)
+	// asmBlockEndRx matches the lines ending the code of a function.
+	asmBlockEndRx = regexp.MustCompile(`^(TEXT|DATA|GLOBL)\b`)
+	// asmRefRx matches the references to the functions of the package.
+	asmRefRx = regexp.MustCompile(`(?:^|[^\w./])·(\w+)\(SB\)`)
+)
+
+// asmBlock is the code of a function in an assembly file, or the code
+// between the functions if name is "".
+type asmBlock struct {
+	name  string
+	lines []string
+}
+
+// pruneAsm removes the functions of the assembly files of a package that
+// aren't among its declared Go functions, unless the kept assembly code
+// of any of the files refers to them. The preprocessor directives within
+// the removed functions are kept as the conditionals may span several
+// functions.
+func pruneAsm(filenames []string, funcs map[string]bool) error {
+	files := make([][]*asmBlock, len(filenames))
+	for i, filename := range filenames {
+		blocks, err := parseAsm(filename)
+		if err != nil {
+			return err
+		}
+		files[i] = blocks
+	}
+
+	keep := make(map[string]bool)
+	for name := range funcs {
+		keep[name] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, blocks := range files {
+			for _, b := range blocks {
+				if b.name != "" && !keep[b.name] {
+					continue
+				}
+				for _, l := range b.lines {
+					for _, m := range asmRefRx.FindAllStringSubmatch(l, -1) {
+						if !keep[m[1]] {
+							keep[m[1]] = true
+							changed = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for i, filename := range filenames {
+		if err := writeAsm(filename, files[i], keep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAsm splits the assembly file filename into blocks.
+func parseAsm(filename string) ([]*asmBlock, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	blocks := []*asmBlock{{}}
+	sc := bufio.NewScanner(bytes.NewReader(src))
+	for sc.Scan() {
+		l := sc.Text()
+		if m := asmTextRx.FindStringSubmatch(l); m != nil {
+			blocks = append(blocks, &asmBlock{name: m[1]})
+		} else if asmBlockEndRx.MatchString(l) && blocks[len(blocks)-1].name != "" {
+			blocks = append(blocks, &asmBlock{})
+		}
+		b := blocks[len(blocks)-1]
+		b.lines = append(b.lines, l)
+	}
+	return blocks, sc.Err()
+}
+
+// writeAsm writes the blocks of the assembly file filename back without
+// the functions not in keep. The file isn't touched if all are kept.
+func writeAsm(filename string, blocks []*asmBlock, keep map[string]bool) error {
+	var buf bytes.Buffer
+	removed := false
+	for _, b := range blocks {
+		removing := b.name != "" && !keep[b.name]
+		if removing {
+			Verbosef("Removing assembly function %s from %s", b.name, filename)
+			removed = true
+		}
+		directive := false
+		for _, l := range b.lines {
+			if strings.HasPrefix(strings.TrimSpace(l), "#") {
+				directive = true
+			}
+			if !removing || directive {
+				buf.WriteString(l)
+				buf.WriteByte('\n')
+			}
+			// A directive continues on the next line after a backslash.
+			directive = directive && strings.HasSuffix(l, "\\")
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
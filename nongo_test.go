@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeepDirectives(t *testing.T) {
+	src := `//go:build linux
+
+// Package P is documented.
+package P
+
+/*
+#include <stdio.h>
+*/
+import "C"
+
+import _ "embed"
+
+// Text is embedded.
+//
+//go:embed a.txt
+var Text string
+
+type (
+	// T is not in the heap.
+	//go:notinheap
+	T struct{}
+)
+
+// F does nothing.
+//go:noinline
+func F() {
+	// A comment.
+}
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "P.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepDirectives(f)
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{"//go:build linux", "#include <stdio.h>", "//go:embed a.txt", "//go:notinheap", "//go:noinline"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q missing in:\n%s", want, got)
+		}
+	}
+	for _, dropped := range []string{"documented", "embedded", "not in the heap", "does nothing", "A comment"} {
+		if strings.Contains(got, dropped) {
+			t.Errorf("%q not dropped in:\n%s", dropped, got)
+		}
+	}
+}
+
+func TestEmbedMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"*.txt", "a.txt", true},
+		{"data", "data/x/a.txt", true},
+		{"all:data", "data/.hidden", true},
+		{"data/*.txt", "data/a.txt", true},
+		{"data/*.txt", "data/x/a.txt", false},
+		{"b.txt", "a.txt", false},
+	}
+	for _, tt := range tests {
+		if got := embedMatch(tt.pattern, tt.name); got != tt.match {
+			t.Errorf("embedMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.match)
+		}
+	}
+}
+
+func TestPruneNonGo(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"P.go":  "package P\n\nimport _ \"embed\"\n\n//go:embed a.txt\nvar A string\n\nfunc add(a, b int) int\n",
+		"a.txt": "a",
+		"b.txt": "b",
+		"add_amd64.s": "#include \"textflag.h\"\n\nTEXT ·add(SB),NOSPLIT,$0-24\n\tCALL ·helper(SB)\n\tRET\n\n" +
+			"TEXT ·helper(SB),NOSPLIT,$0\n\tCALL ·shared(SB)\n\tJMP ·inner(SB)\n\n" +
+			"TEXT ·inner(SB),NOSPLIT,$0\n\tRET\n\n" +
+			"TEXT ·sub(SB),NOSPLIT,$0-24\n#ifdef GOAMD64_v3\n\tNOP\n#endif\n\tSUBQ AX, BX\n\tRET\n\n" +
+			"DATA ·c+0(SB)/8, $1\nGLOBL ·c(SB), RODATA, $8\n",
+		"util_amd64.s": "TEXT ·shared(SB),NOSPLIT,$0\n\tRET\n\n" +
+			"TEXT ·unshared(SB),NOSPLIT,$0\n\tRET\n",
+	}
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copied := map[string]*nonGoPkg{dir: {
+		files:  []string{"a.txt", "add_amd64.s", "b.txt", "util_amd64.s"},
+		sfiles: []string{"add_amd64.s", "util_amd64.s"},
+		embeds: []string{"a.txt", "b.txt"},
+	}}
+	if err := pruneNonGo(copied); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Errorf("a.txt removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("b.txt not removed: %v", err)
+	}
+	asm, err := ioutil.ReadFile(filepath.Join(dir, "add_amd64.s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"TEXT ·add", "TEXT ·helper", "TEXT ·inner", "DATA ·c", "GLOBL ·c", "#ifdef", "#endif"} {
+		if !bytes.Contains(asm, []byte(want)) {
+			t.Errorf("%q missing in:\n%s", want, asm)
+		}
+	}
+	for _, removed := range []string{"·sub", "SUBQ"} {
+		if bytes.Contains(asm, []byte(removed)) {
+			t.Errorf("%q not removed:\n%s", removed, asm)
+		}
+	}
+
+	util, err := ioutil.ReadFile(filepath.Join(dir, "util_amd64.s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(util, []byte("TEXT ·shared")) {
+		t.Errorf("function referred to by another file removed:\n%s", util)
+	}
+	if bytes.Contains(util, []byte("·unshared")) {
+		t.Errorf("·unshared not removed:\n%s", util)
+	}
+}
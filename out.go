@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// outModule is the module path of the module written to the -out
+// directory, and outPkgDir the directory of the sliced packages in it.
+const (
+	outModule = "sliced"
+	outPkgDir = "pkg"
+)
+
+// writeOutModule writes the sliced packages of results and the usage
+// programs from the workspace to dir as a Go module. The sliced packages
+// replace the modules they come from: each of those modules is copied
+// under its module path in outPkgDir with its packages sliced, so that
+// every import path is provided by a single module. A package outside
+// any module becomes a module of its own. The standard library can't be
+// replaced, so sliced standard packages are left out.
+func writeOutModule(dir string, results []*CoverResult) error {
+	if err := resetOutDir(dir); err != nil {
+		return err
+	}
+	sliced := filepath.Join(*workspace, "src", dstPackage)
+	vendor := filepath.Join(sliced, "vendor")
+	err := copyTree(dir, sliced, func(rel string) bool { return rel == "vendor" })
+	if err != nil {
+		return err
+	}
+	pkgDir := filepath.Join(dir, outPkgDir)
+
+	origDirs := make(map[string]string)
+	for _, cr := range results {
+		path, err := slicedPath(cr)
+		if err != nil {
+			return err
+		}
+		origDirs[filepath.ToSlash(filepath.Dir(path))] = filepath.Dir(cr.Filename)
+	}
+	pkgs, err := goPackages(vendor)
+	if err != nil {
+		return err
+	}
+	version := goModVersion()
+	mods := make(map[string]bool)
+	for _, path := range pkgs {
+		if isStdPkg(path) {
+			log.Printf("Leaving out sliced standard package %s: it can't be replaced in a module", path)
+			continue
+		}
+		mod := path
+		if root, modPath := findModule(origDirs[path]); root != "" && (path == modPath || strings.HasPrefix(path, modPath+"/")) {
+			mod = modPath
+			if !mods[mod] {
+				if err := copyModule(filepath.Join(pkgDir, filepath.FromSlash(mod)), root); err != nil {
+					return err
+				}
+			}
+		}
+		dst := filepath.Join(pkgDir, filepath.FromSlash(path))
+		if err := replacePkgFiles(dst, filepath.Join(vendor, filepath.FromSlash(path))); err != nil {
+			return err
+		}
+		if mod == path && !mods[mod] {
+			gomod := fmt.Sprintf("module %s\n%s", path, version)
+			if _, err := os.Stat(filepath.Join(dst, "go.mod")); os.IsNotExist(err) {
+				if err := ioutil.WriteFile(filepath.Join(dst, "go.mod"), []byte(gomod), 0644); err != nil {
+					return err
+				}
+			}
+		}
+		mods[mod] = true
+	}
+
+	var gomod bytes.Buffer
+	fmt.Fprintf(&gomod, "module %s\n%s", outModule, version)
+	if len(mods) > 0 {
+		gomod.WriteString("\nrequire (\n")
+		for _, path := range sortedKeys(mods) {
+			fmt.Fprintf(&gomod, "\t%s v0.0.0\n", path)
+		}
+		gomod.WriteString(")\n\nreplace (\n")
+		for _, path := range sortedKeys(mods) {
+			fmt.Fprintf(&gomod, "\t%s => ./%s/%s\n", path, outPkgDir, path)
+		}
+		gomod.WriteString(")\n")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), gomod.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	// Let the go command add the dependencies the sliced packages have
+	// outside of the module and write go.sum.
+	cmd := exec.Command("go", "mod", "tidy")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=on", "GOFLAGS=-mod=mod")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("tidying module %s: %v\n%s", dir, err, stderr.Bytes())
+	}
+	return nil
+}
+
+var moduleRx = regexp.MustCompile(`(?m)^module\s+"?([^"\s]+)"?`)
+
+// findModule returns the root directory and the path of the module
+// containing dir, or "" if dir isn't in a module.
+func findModule(dir string) (root, path string) {
+	if dir == "" {
+		return "", ""
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		if b, err := ioutil.ReadFile(filepath.Join(d, "go.mod")); err == nil {
+			if m := moduleRx.FindSubmatch(b); m != nil {
+				return d, string(m[1])
+			}
+			return "", ""
+		}
+		if filepath.Dir(d) == d {
+			return "", ""
+		}
+	}
+}
+
+// copyModule copies the module in root to dst the way the go command sees
+// it: without the nested modules, the test files and the directories the
+// go command ignores.
+func copyModule(dst, root string) error {
+	return copyTree(dst, root, func(rel string) bool {
+		name := path.Base(rel)
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || strings.HasSuffix(name, "_test.go") ||
+			name == "testdata" || name == "vendor" {
+			return true
+		}
+		fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel), "go.mod"))
+		return err == nil && !fi.IsDir()
+	})
+}
+
+// replacePkgFiles replaces the files of the package in dst with the files
+// of the sliced package in src. Go files the slicing removed are deleted.
+func replacePkgFiles(dst, src string) error {
+	fis, err := ioutil.ReadDir(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".go") {
+			if err := os.Remove(filepath.Join(dst, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return copyTree(dst, src, nil)
+}
+
+// resetOutDir empties the output directory dir. Like a workspace, an
+// existing directory is only removed if it's empty or if slicer wrote it,
+// which is told by the module path in its go.mod.
+func resetOutDir(dir string) error {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(dir, 0755)
+	} else if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(1)
+	f.Close()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(names) > 0 {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+		if err != nil || !bytes.HasPrefix(b, []byte("module "+outModule+"\n")) {
+			return fmt.Errorf("refusing to remove %s: not a module written by slicer", dir)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// goPackages returns the import paths of the directories under root
+// containing Go files, relative to root.
+func goPackages(root string) ([]string, error) {
+	seen := make(map[string]bool)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(path, ".go") {
+			return err
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		seen[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return sortedKeys(seen), err
+}
+
+func isStdPkg(path string) bool {
+	fi, err := os.Stat(filepath.Join(build.Default.GOROOT, "src", filepath.FromSlash(path)))
+	return err == nil && fi.IsDir()
+}
+
+var goVersionRx = regexp.MustCompile(`go(\d+\.\d+)`)
+
+// goModVersion returns the go directive of the written go.mod files.
+func goModVersion() string {
+	m := goVersionRx.FindStringSubmatch(goVersion())
+	if m == nil {
+		return ""
+	}
+	return "\ngo " + m[1] + "\n"
+}
+
+// copyTree copies the files under src to dst, except for the paths
+// relative to src for which skip returns true.
+func copyTree(dst, src string, skip func(rel string) bool) error {
+	var files []string
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if skip != nil && rel != "." && skip(filepath.ToSlash(rel)) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.IsDir() {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	return copyPkgFiles(dst, src, files)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResetOutDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	if err := resetOutDir(dir); err != nil {
+		t.Fatalf("missing directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module "+outModule+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := resetOutDir(dir); err != nil {
+		t.Fatalf("written module: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); !os.IsNotExist(err) {
+		t.Errorf("go.mod not removed: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/mine\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := resetOutDir(dir); err == nil {
+		t.Errorf("a foreign module removed")
+	}
+}
+
+func TestGoPackages(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a/a.go": "", "a/b/b.go": "", "a/data/x.txt": "", "c/c.s": ""})
+	pkgs, err := goPackages(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "a/b"}; !reflect.DeepEqual(pkgs, want) {
+		t.Errorf("got %v, want %v", pkgs, want)
+	}
+}
+
+func TestCopyModule(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "m")
+	writeFiles(t, root, map[string]string{
+		"go.mod":               "module example.com/m\n\ngo 1.16\n",
+		"lib/lib.go":           "package lib\n",
+		"lib/gone.go":          "package lib\n",
+		"lib/lib_test.go":      "package lib\n",
+		"lib/testdata/x.txt":   "x",
+		"other/other.go":       "package other\n",
+		"nested/go.mod":        "module example.com/m/nested\n",
+		"nested/nested.go":     "package nested\n",
+		".git/config":          "",
+		"sliced/lib/lib.go":    "package lib\n\n// Sliced.\n",
+		"sliced/lib/asm_386.s": "",
+	})
+	if dir, path := findModule(filepath.Join(root, "lib")); dir != root || path != "example.com/m" {
+		t.Errorf("findModule = %q, %q; want %q, example.com/m", dir, path, root)
+	}
+	if dir, _ := findModule(tmp); dir != "" {
+		t.Errorf("findModule outside a module = %q, want none", dir)
+	}
+
+	dst := filepath.Join(tmp, "out")
+	if err := copyModule(dst, root); err != nil {
+		t.Fatal(err)
+	}
+	if err := replacePkgFiles(filepath.Join(dst, "lib"), filepath.Join(root, "sliced/lib")); err != nil {
+		t.Fatal(err)
+	}
+	for name, exists := range map[string]bool{
+		"go.mod": true, "lib/lib.go": true, "lib/asm_386.s": true, "other/other.go": true,
+		"lib/gone.go": false, "lib/lib_test.go": false, "lib/testdata": false, "nested": false, ".git": false,
+	} {
+		if _, err := os.Stat(filepath.Join(dst, filepath.FromSlash(name))); (err == nil) != exists {
+			t.Errorf("%s: exists = %v, want %v", name, err == nil, exists)
+		}
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dst, "lib/lib.go")); string(b) != "package lib\n\n// Sliced.\n" {
+		t.Errorf("lib.go not sliced: %q", b)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "sync"
+
+// forEach calls fn for every i in [0, n), running at most *jobs calls
+// at the same time. It waits for all of them to finish and returns the
+// error of the call with the lowest i, so the outcome doesn't depend on
+// how the calls were scheduled.
+func forEach(n int, fn func(i int) error) error {
+	workers := *jobs
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	errs := make([]error, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
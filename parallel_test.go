@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForEachErrors(t *testing.T) {
+	defer func(old int) { *jobs = old }(*jobs)
+	for _, j := range []int{1, 4} {
+		*jobs = j
+		var calls int32
+		err := forEach(10, func(i int) error {
+			atomic.AddInt32(&calls, 1)
+			if i == 3 || i == 7 {
+				return fmt.Errorf("call %d", i)
+			}
+			return nil
+		})
+		if err == nil || err.Error() != "call 3" {
+			t.Errorf("-j %d: got error %v, want call 3", j, err)
+		}
+		if calls != 10 {
+			t.Errorf("-j %d: %d calls, want 10", j, calls)
+		}
+
+		errLast := errors.New("last")
+		if err := forEach(5, func(i int) error {
+			if i == 4 {
+				return errLast
+			}
+			return nil
+		}); err != errLast {
+			t.Errorf("-j %d: got error %v, want %v", j, err, errLast)
+		}
+		if err := forEach(0, func(i int) error { return errLast }); err != nil {
+			t.Errorf("-j %d: no calls: got error %v", j, err)
+		}
+	}
+}
+
+func TestSliceJobs(t *testing.T) {
+	defer func(old int) { *jobs = old }(*jobs)
+	defer func(old string) { *workspace = old }(*workspace)
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var results []*CoverResult
+	for i := 0; i < 8; i++ {
+		name := filepath.Join(src, fmt.Sprintf("f%d.go", i))
+		code := fmt.Sprintf("package p\n\nfunc F%d(x int) int {\n\tif x > 0 {\n\t\treturn x\n\t}\n\treturn 0\n}\n", i)
+		if err := ioutil.WriteFile(name, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, &CoverResult{
+			Filename: name,
+			Package:  "p",
+			Removes:  []CoverPos{{4, 2, 6, 2}},
+		})
+	}
+
+	sliced := func(j int) map[string]string {
+		*jobs = j
+		*workspace = filepath.Join(tmp, fmt.Sprintf("ws%d", j))
+		if err := applyResults(results, nil); err != nil {
+			t.Fatalf("-j %d: %v", j, err)
+		}
+		files := make(map[string]string)
+		dir := filepath.Join(*workspace, "src", dstPackage)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			files[rel] = string(b)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+	seq, par := sliced(1), sliced(4)
+	if len(seq) != len(results) {
+		t.Fatalf("-j 1: got %d files, want %d", len(seq), len(results))
+	}
+	if !reflect.DeepEqual(seq, par) {
+		t.Errorf("-j 4 sliced differently from -j 1:\n%v\n%v", par, seq)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"os/exec"
+	"strings"
+)
+
+// platform is a target platform of the sliced packages.
+type platform struct {
+	GOOS, GOARCH string
+}
+
+var (
+	hostPlatform = platform{build.Default.GOOS, build.Default.GOARCH}
+	hostCgo      = build.Default.CgoEnabled
+)
+
+func (pl platform) String() string { return pl.GOOS + "/" + pl.GOARCH }
+
+// context returns the default build context set to the platform.
+func (pl platform) context() build.Context {
+	ctx := build.Default
+	ctx.GOOS = pl.GOOS
+	ctx.GOARCH = pl.GOARCH
+	// Cross builds have cgo disabled by default.
+	ctx.CgoEnabled = hostCgo && pl == hostPlatform
+	return ctx
+}
+
+// env returns the environment variables selecting the platform.
+func (pl platform) env() []string {
+	env := []string{"GOOS=" + pl.GOOS, "GOARCH=" + pl.GOARCH}
+	if pl != hostPlatform {
+		env = append(env, "CGO_ENABLED=0")
+	}
+	return env
+}
+
+// execWrapper returns the program running binaries of the platform on
+// this machine, following the convention of go run: go_$GOOS_$GOARCH_exec
+// found in PATH. It returns "" if the binaries are run directly.
+func (pl platform) execWrapper() string {
+	if pl == hostPlatform {
+		return ""
+	}
+	path, err := exec.LookPath(fmt.Sprintf("go_%s_%s_exec", pl.GOOS, pl.GOARCH))
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// platformList is a flag with a comma-separated list of platforms.
+type platformList []platform
+
+func (l *platformList) String() string {
+	var s []string
+	for _, pl := range *l {
+		s = append(s, pl.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *platformList) Set(s string) error {
+	*l = nil
+	for _, f := range strings.Split(s, ",") {
+		i := strings.IndexByte(f, '/')
+		if i <= 0 || i == len(f)-1 {
+			return fmt.Errorf("%q is not of the form GOOS/GOARCH", f)
+		}
+		*l = append(*l, platform{f[:i], f[i+1:]})
+	}
+	return nil
+}
+
+// targetPlatforms returns the platforms the sliced packages must build for.
+func targetPlatforms() []platform {
+	if len(platforms) == 0 {
+		return []platform{hostPlatform}
+	}
+	return platforms
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlatformList(t *testing.T) {
+	var l platformList
+	if err := l.Set("linux/amd64,windows/386"); err != nil {
+		t.Fatal(err)
+	}
+	want := platformList{{"linux", "amd64"}, {"windows", "386"}}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("got %v, want %v", l, want)
+	}
+	if got := l.String(); got != "linux/amd64,windows/386" {
+		t.Errorf("got %q", got)
+	}
+	for _, bad := range []string{"linux", "/amd64", "linux/", "linux/amd64,"} {
+		if err := l.Set(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestUnusedOnAll(t *testing.T) {
+	plats := []platform{{"linux", "amd64"}, {"windows", "amd64"}}
+	common := objPos{"/w/p.go", 10}
+	linux := objPos{"/w/p_linux.go", 20}
+	reported := []map[objPos]bool{
+		{common: true, linux: true},
+		{},
+	}
+	if unusedOnAll(plats, reported, common) {
+		t.Errorf("%v is used on windows", common)
+	}
+	if !unusedOnAll(plats, reported, linux) {
+		t.Errorf("%v isn't built on windows", linux)
+	}
+	reported[1][common] = true
+	if !unusedOnAll(plats, reported, common) {
+		t.Errorf("%v is unused on both platforms", common)
+	}
+}
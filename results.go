@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// resultsVersion is the version of the format of saved coverage results.
+// It changes whenever the format changes incompatibly.
+const resultsVersion = 1
+
+// SavedResults are coverage results stored in a file.
+type SavedResults struct {
+	Version int            `json:"version"`
+	Mode    string         `json:"mode"` // cover mode the results were collected in
+	Results []*CoverResult `json:"results"`
+}
+
+// writeResults saves the results collected in the cover mode mode
+// to filename.
+func writeResults(filename, mode string, results []*CoverResult) error {
+	b, err := json.MarshalIndent(SavedResults{resultsVersion, mode, results}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, append(b, '\n'))
+}
+
+// readResults reads the results saved to filename.
+func readResults(filename string) (*SavedResults, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var sr SavedResults
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sr); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if sr.Version != resultsVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d of coverage results, want %d", filename, sr.Version, resultsVersion)
+	}
+	return &sr, nil
+}
+
+// fileHash returns the hash identifying the content of the file name.
+func fileHash(name string) (string, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return dataHash(b), nil
+}
+
+func dataHash(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
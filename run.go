@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// envList is a flag collecting NAME=value pairs.
+type envList []string
+
+func (l *envList) String() string { return strings.Join(*l, " ") }
+
+func (l *envList) Set(s string) error {
+	if i := strings.IndexByte(s, '='); i <= 0 {
+		return fmt.Errorf("%q is not of the form NAME=value", s)
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+// buildProg builds the program consisting of files in dir for the
+// platform pl, using the workspace as GOPATH, and returns the path of
+// the binary.
+func buildProg(dir string, files []string, pl platform) (string, error) {
+	gopath, err := filepath.Abs(*workspace)
+	if err != nil {
+		return "", err
+	}
+	// Name the binary after the whole import path of the program, as
+	// programs of different trees may share the last element.
+	rel, err := filepath.Rel(filepath.Join(gopath, "src"), dir)
+	if err != nil {
+		return "", err
+	}
+	bin := filepath.Join(gopath, "bin", strings.Replace(filepath.ToSlash(rel), "/", "-", -1))
+	args := []string{"build", "-o", bin}
+	if *race {
+		args = append(args, "-race")
+	}
+	cmd := exec.Command("go", append(args, files...)...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "GOPATH="+gopath, "GO111MODULE=off"), pl.env()...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("building %s: %v", dir, err)
+	}
+	return bin, nil
+}
+
+// killGrace is how long a timed out program has to write the coverage
+// data before it's killed.
+const killGrace = 5 * time.Second
+
+// runCoverBin runs the coverage program bin in dir the way the user asked
+// for: with the program arguments, the additional environment variables,
+// the standard input and the limits. Binaries of other platforms than the
+// host are run by their exec wrapper, if there's one. The program writes
+// the coverage data to out, so its standard output is left alone. If the
+// program was stopped for exceeding a limit, the data is partial.
+func runCoverBin(bin, dir, out string, pl platform) (data []byte, partial bool, err error) {
+	name, args := bin, progArgs
+	if w := pl.execWrapper(); w != "" {
+		name, args = w, append([]string{bin}, progArgs...)
+	}
+	cmd, err := limitedCommand(name, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), progEnv...)
+	if *progStdin != "" {
+		f, err := os.Open(*progStdin)
+		if err != nil {
+			return nil, false, err
+		}
+		defer f.Close()
+		cmd.Stdin = f
+	}
+	stderr := &tailWriter{w: os.Stderr}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, false, fmt.Errorf("running coverage program: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var timer <-chan time.Time
+	if *timeout > 0 {
+		timer = time.After(*timeout)
+	}
+	select {
+	case err = <-done:
+	case <-timer:
+		// The program writes the coverage data on SIGTERM.
+		signalProcessGroup(cmd, syscall.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(killGrace):
+			signalProcessGroup(cmd, syscall.SIGKILL)
+			<-done
+		}
+		return partialCoverage(out, fmt.Sprintf("timeout of %v", *timeout))
+	}
+	if *cpuLimit > 0 && killedByLimit(cmd.ProcessState) {
+		// The program writes the coverage data on SIGXCPU, which is
+		// sent when the soft limit is reached.
+		return partialCoverage(out, fmt.Sprintf("CPU time limit of %v", *cpuLimit))
+	}
+	if err != nil {
+		if *memLimit > 0 && bytes.Contains(stderr.Bytes(), []byte("out of memory")) {
+			return nil, false, fmt.Errorf("running coverage program: memory limit of %d MB exceeded", *memLimit)
+		}
+		// The data is written after the slice function finishes,
+		// e.g. a failed test makes the program exit with an error
+		// afterwards.
+		data, rerr := ioutil.ReadFile(out)
+		if rerr != nil {
+			return nil, false, fmt.Errorf("running coverage program: %v", err)
+		}
+		log.Printf("Coverage program: %v", err)
+		return data, false, nil
+	}
+	data, err = ioutil.ReadFile(out)
+	return data, false, err
+}
+
+// partialCoverage returns the coverage data written by a program that
+// was stopped for exceeding limit.
+func partialCoverage(out, limit string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		return nil, true, fmt.Errorf("%s exceeded and no coverage collected", limit)
+	}
+	log.Printf("Using partial coverage: %s exceeded", limit)
+	return data, true, nil
+}
+
+// limitedCommand returns a command running name with the resource limits
+// applied. The limits are set by the shell, which then replaces itself
+// with the program, so the program's pid is the one of the command.
+func limitedCommand(name string, args ...string) (*exec.Cmd, error) {
+	if *memLimit <= 0 && *cpuLimit <= 0 {
+		return exec.Command(name, args...), nil
+	}
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("resource limits are only supported on Linux")
+	}
+	var script bytes.Buffer
+	if *memLimit > 0 {
+		fmt.Fprintf(&script, "ulimit -d %d && ", *memLimit*1024)
+	}
+	if *cpuLimit > 0 {
+		// Leave the program some time to write the coverage data
+		// between the soft and the hard limit.
+		secs := int((*cpuLimit + time.Second - 1) / time.Second)
+		fmt.Fprintf(&script, "ulimit -S -t %d && ulimit -H -t %d && ", secs, secs+int(killGrace/time.Second))
+	}
+	script.WriteString(`exec "$0" "$@"`)
+	return exec.Command("/bin/sh", append([]string{"-c", script.String(), name}, args...)...), nil
+}
+
+// tailWriter passes the writes to w and remembers the last few
+// kilobytes written.
+type tailWriter struct {
+	w    io.Writer
+	tail []byte
+}
+
+const tailSize = 4096
+
+func (tw *tailWriter) Write(p []byte) (int, error) {
+	tw.tail = append(tw.tail, p...)
+	if len(tw.tail) > tailSize {
+		tw.tail = tw.tail[len(tw.tail)-tailSize:]
+	}
+	return tw.w.Write(p)
+}
+
+func (tw *tailWriter) Bytes() []byte { return tw.tail }
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup can only kill the process itself on this platform.
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	cmd.Process.Kill()
+}
+
+// killedByLimit reports false: resource limits aren't supported on this
+// platform.
+func killedByLimit(ps *os.ProcessState) bool { return false }
@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd start a new process group, so that all the
+// processes it spawns can be signalled at once.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+// killedByLimit reports whether the process ps was killed for exceeding
+// the CPU time limit: by SIGXCPU at the soft limit or by SIGKILL at the
+// hard one. The coverage program kills itself with SIGKILL after writing
+// the data on SIGXCPU. As SIGKILL has other senders, such as the OOM
+// killer, it only counts if the process used up the limit.
+func killedByLimit(ps *os.ProcessState) bool {
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return false
+	}
+	switch ws.Signal() {
+	case syscall.SIGXCPU:
+		return true
+	case syscall.SIGKILL:
+		return *cpuLimit > 0 && ps.UserTime()+ps.SystemTime() >= *cpuLimit
+	}
+	return false
+}
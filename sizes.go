@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// symbolSizes returns the total sizes of the symbols of the binaries, by
+// their names as listed by go tool nm. The vendor directories of the
+// programs in the workspace are dropped from the names so that the names
+// of the original and the sliced programs match.
+func symbolSizes(bins []string) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	for _, bin := range bins {
+		cmd := exec.Command("go", "tool", "nm", "-size", bin)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("listing the symbols of %s: %v\n%s", bin, err, stderr.Bytes())
+		}
+		parseSymbols(bytes.NewReader(out), sizes)
+	}
+	return sizes, nil
+}
+
+// parseSymbols adds the sizes of the symbols from the output of
+// go tool nm -size to sizes.
+func parseSymbols(r io.Reader, sizes map[string]int64) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		// address size type name
+		f := strings.Fields(sc.Text())
+		if len(f) < 4 || f[2] == "U" {
+			continue
+		}
+		size, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		name := strings.Join(f[3:], " ")
+		for _, root := range []string{dstPackage, origPackage} {
+			name = strings.Replace(name, root+"/vendor/", "", -1)
+		}
+		sizes[name] += size
+	}
+}
+
+// symbolPackage returns the import path of the package the symbol name
+// belongs to, or "" if it's not known. The type arguments of generic
+// symbols, which are import paths too, are left out, and the dots the
+// linker escapes in the last elements of import paths are unescaped.
+func symbolPackage(name string) string {
+	if strings.HasPrefix(name, "go:") {
+		// Generated by the linker.
+		return ""
+	}
+	name = strings.TrimPrefix(name, "type:")
+	name = strings.TrimLeft(name, "*[]")
+	name = stripTypeArgs(name)
+	slash := strings.LastIndex(name, "/") + 1
+	if i := strings.Index(name[slash:], "."); i > 0 {
+		return strings.Replace(name[:slash+i], "%2e", ".", -1)
+	}
+	return ""
+}
+
+// stripTypeArgs removes the bracketed type arguments from the symbol
+// name.
+func stripTypeArgs(name string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range name {
+		switch {
+		case r == '[':
+			depth++
+		case r == ']' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+type sizeDiff struct {
+	name         string
+	orig, sliced int64
+}
+
+func (d sizeDiff) diff() int64 { return d.sliced - d.orig }
+
+// sizeDiffs returns the differences of the sizes of the symbols or, if
+// byPackage is true, of the packages, ordered by the biggest savings
+// first. Unchanged ones are left out.
+func sizeDiffs(orig, sliced map[string]int64, byPackage bool) []sizeDiff {
+	m := make(map[string]*sizeDiff)
+	get := func(name string) *sizeDiff {
+		if byPackage {
+			name = symbolPackage(name)
+			if name == "" {
+				name = "(other)"
+			}
+		}
+		d := m[name]
+		if d == nil {
+			d = &sizeDiff{name: name}
+			m[name] = d
+		}
+		return d
+	}
+	for name, size := range orig {
+		get(name).orig += size
+	}
+	for name, size := range sliced {
+		get(name).sliced += size
+	}
+	var diffs []sizeDiff
+	for _, d := range m {
+		if d.diff() != 0 {
+			diffs = append(diffs, *d)
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].diff() != diffs[j].diff() {
+			return diffs[i].diff() < diffs[j].diff()
+		}
+		return diffs[i].name < diffs[j].name
+	})
+	return diffs
+}
+
+// printSizeReport writes the differences of the symbol sizes of the
+// original and the sliced programs by package and, for the n symbols
+// changing most, by symbol.
+func printSizeReport(w io.Writer, orig, sliced map[string]int64, n int) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	table := func(title string, diffs []sizeDiff) {
+		fmt.Fprintf(tw, "%s\tORIGINAL\tSLICED\tDIFF\n", title)
+		for _, d := range diffs {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%+d\n", d.name, d.orig, d.sliced, d.diff())
+		}
+	}
+	table("PACKAGE", sizeDiffs(orig, sliced, true))
+	fmt.Fprintln(tw)
+	syms := sizeDiffs(orig, sliced, false)
+	sort.SliceStable(syms, func(i, j int) bool { return abs(syms[i].diff()) > abs(syms[j].diff()) })
+	if len(syms) > n {
+		syms = syms[:n]
+	}
+	table("SYMBOL", syms)
+	tw.Flush()
+}
+
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
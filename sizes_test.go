@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSymbolSizes(t *testing.T) {
+	const origNm = `  4a1000        120 T intact/vendor/example.com/lib.F
+  4a1100         80 T intact/vendor/example.com/lib.(*T).M
+  4a1200         40 T intact/vendor/example.com/lib.G.func1
+  52a000         16 R type:*intact/vendor/example.com/lib.T
+  47db00         30 T main.main
+                    U runtime.x
+`
+	const slicedNm = `  4a1000        100 T sliced/vendor/example.com/lib.F
+  52a000         16 R type:*sliced/vendor/example.com/lib.T
+  47db00         30 T main.main
+`
+	orig, sliced := make(map[string]int64), make(map[string]int64)
+	parseSymbols(strings.NewReader(origNm), orig)
+	parseSymbols(strings.NewReader(slicedNm), sliced)
+	want := map[string]int64{
+		"example.com/lib.F":       100,
+		"type:*example.com/lib.T": 16,
+		"main.main":               30,
+	}
+	if !reflect.DeepEqual(sliced, want) {
+		t.Errorf("got symbols %v, want %v", sliced, want)
+	}
+
+	for name, pkg := range map[string]string{
+		"example.com/lib.(*T).M":     "example.com/lib",
+		"type:*example.com/lib.T":    "example.com/lib",
+		"main.main":                  "main",
+		"runtime.text":               "runtime",
+		"go:func.*":                  "",
+		"gopkg.in/yaml%2ev2.Marshal": "gopkg.in/yaml.v2",
+		"example.com/lib.Map[example.com/other.T,int]":        "example.com/lib",
+		"example.com/lib.(*Set[go.shape.string]).Add":         "example.com/lib",
+		"type:*example.com/lib.List[gopkg.in/yaml%2ev2.Node]": "example.com/lib",
+	} {
+		if got := symbolPackage(name); got != pkg {
+			t.Errorf("symbolPackage(%q) = %q, want %q", name, got, pkg)
+		}
+	}
+
+	gotPkgs := sizeDiffs(orig, sliced, true)
+	wantPkgs := []sizeDiff{{"example.com/lib", 256, 116}}
+	if !reflect.DeepEqual(gotPkgs, wantPkgs) {
+		t.Errorf("got package diffs %v, want %v", gotPkgs, wantPkgs)
+	}
+	gotSyms := sizeDiffs(orig, sliced, false)
+	wantSyms := []sizeDiff{
+		{"example.com/lib.(*T).M", 80, 0},
+		{"example.com/lib.G.func1", 40, 0},
+		{"example.com/lib.F", 120, 100},
+	}
+	if !reflect.DeepEqual(gotSyms, wantSyms) {
+		t.Errorf("got symbol diffs %v, want %v", gotSyms, wantSyms)
+	}
+}
@@ -5,53 +5,90 @@ import (
 	"go/ast"
 	"go/build"
 	"go/parser"
-	"go/printer"
 	"go/token"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode/utf8"
 )
 
-func sliceFile(dstDir string, cr *CoverResult) error {
+// sliceFile removes the blocks of the file of cr executed fewer than
+// minCount times and writes the result to dstDir.
+func sliceFile(dstDir string, cr *CoverResult, minCount int) error {
 	code, err := ioutil.ReadFile(cr.Filename)
 	if err != nil {
 		return err
 	}
 
-	path := makePathRelative(cr.Filename)
-	if path == "" {
-		return fmt.Errorf("cannot find package for file: %s", cr.Filename)
+	if cr.Hash != "" && cr.Hash != dataHash(code) {
+		return fmt.Errorf("file changed since the coverage was collected")
 	}
-	Verbosef("Slicing file: %s", path)
-	offsets := make([]Uncovered, 0, len(cr.Removes))
-	for _, rem := range cr.Removes {
-		off0, off1 := findOffsets(code, rem)
-		Verbosef("#%d,%d\n", off0, off1)
-		offsets = append(offsets, Uncovered{off0, off1})
-	}
-	Verbosef("")
 
+	path, err := slicedPath(cr)
+	if err != nil {
+		return err
+	}
+	Verbosef("Slicing file: %s", path)
 	fset := token.NewFileSet()
-	fileAST, err := parser.ParseFile(fset, cr.Filename, code, 0)
+	fileAST, err := parser.ParseFile(fset, cr.Filename, code, parser.ParseComments)
 	if err != nil {
 		return err
 	}
 
-	sp := NewStmtPruner(fset, offsets)
-	if sp.Update(fileAST) == nil {
-		return nil
+	tokFile := fset.File(fileAST.Pos())
+	offsets := make([]Uncovered, 0, len(cr.Removes)+len(cr.Hits))
+	for _, rem := range cr.Removes {
+		off0, off1, err := findOffsets(tokFile, code, rem)
+		if err != nil {
+			return fmt.Errorf("range %v: %v", rem, err)
+		}
+		Verbosef("#%d,%d\n", off0, off1)
+		offsets = append(offsets, Uncovered{off0, off1, 0})
+	}
+	if minCount > 1 {
+		for _, hit := range cr.Hits {
+			off0, off1, err := findOffsets(tokFile, code, hit.CoverPos)
+			if err != nil {
+				return fmt.Errorf("range %v: %v", hit.CoverPos, err)
+			}
+			Verbosef("+%d,%d %d\n", off0, off1, hit.Count)
+			offsets = append(offsets, Uncovered{off0, off1, hit.Count})
+		}
+		raiseEnclosingCounts(fset, fileAST, offsets)
 	}
+	Verbosef("")
+
 	filename := filepath.Join(dstDir, "vendor", path)
+	st := &fileStats{pkg: filepath.ToSlash(filepath.Dir(path)), origLines: tokFile.LineCount()}
+	registerStats(filename, st)
+	sp := NewStmtPruner(fset, offsets, minCount)
+	pruned := sp.Update(fileAST)
+	st.countRemoved(sp.removed)
+	recordStmtPruning(filename, sp)
+	if pruned == nil {
+		return nil
+	}
+	keepDirectives(fileAST)
+	if *markers {
+		markRemoved(fset, fileAST, code, sp.removed)
+	}
 	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
 		return err
 	}
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+	return writeSliced(filename, fset, fileAST)
+}
+
+// slicedPath returns the path of the sliced file of cr relative to the
+// vendor directory of the sliced program.
+func slicedPath(cr *CoverResult) (string, error) {
+	if cr.Package != "" {
+		return filepath.Join(filepath.FromSlash(cr.Package), filepath.Base(cr.Filename)), nil
+	}
+	if path := makePathRelative(cr.Filename); path != "" {
+		return path, nil
 	}
-	defer file.Close()
-	return printer.Fprint(file, fset, fileAST)
+	return "", fmt.Errorf("cannot find package for file: %s", cr.Filename)
 }
 
 func makePathRelative(filename string) string {
@@ -70,29 +107,90 @@ func makePathRelative(filename string) string {
 	panic(fmt.Sprintf("cannot make path %q relative", filename))
 }
 
-func findOffsets(buf []byte, rem CoverPos) (off0, off1 int) {
-	line := 1
-	col := 1
-	for i, b := range buf {
-		if line == rem.Line0 && col == rem.Col0 {
-			off0 = i
-		} else if line == rem.Line1 && col == rem.Col1 {
-			off1 = i + 1
-			return
-		}
-		if b == '\n' {
-			line++
-			col = 1
-			continue
-		}
-		col++
+// findOffsets converts the range rem to offsets in the file f with
+// the content src. The end offset is one past the end of the range.
+func findOffsets(f *token.File, src []byte, rem CoverPos) (off0, off1 int, err error) {
+	if off0, err = lineColOffset(f, src, rem.Line0, rem.Col0); err != nil {
+		return 0, 0, err
+	}
+	if off1, err = lineColOffset(f, src, rem.Line1, rem.Col1); err != nil {
+		return 0, 0, err
 	}
-	panic("shouldn't happen")
+	if off1 < off0 {
+		return 0, 0, fmt.Errorf("end before start")
+	}
+	return off0, off1 + 1, nil
 }
 
+// lineColOffset returns the offset of the 1-based line and column in
+// the file f with the content src. The cover tool reports columns in
+// bytes, the same way go/token does, so in non-ASCII sources a column
+// must point at the start of a UTF-8 sequence; a column pointing inside
+// one is reported as an error.
+func lineColOffset(f *token.File, src []byte, line, col int) (int, error) {
+	if line < 1 || line > f.LineCount() {
+		return 0, fmt.Errorf("line %d out of range [1, %d]", line, f.LineCount())
+	}
+	start := f.Offset(f.LineStart(line))
+	// Offset of the newline terminating the line, or of the end
+	// of the file.
+	end := len(src)
+	if line < f.LineCount() {
+		end = f.Offset(f.LineStart(line+1)) - 1
+	} else if end > 0 && src[end-1] == '\n' {
+		end--
+	}
+	off := start + col - 1
+	if col < 1 || off > end {
+		return 0, fmt.Errorf("column %d out of range [1, %d] on line %d", col, end-start+1, line)
+	}
+	if off < len(src) && !utf8.RuneStart(src[off]) {
+		return 0, fmt.Errorf("%d:%d is not at a character boundary", line, col)
+	}
+	return off, nil
+}
+
+// Uncovered is a block executed Count times. Blocks executed fewer times
+// than the threshold of a StmtPruner are treated as not covered at all.
 type Uncovered struct {
-	Pos int
-	End int
+	Pos   int
+	End   int
+	Count int
+}
+
+// raiseEnclosingCounts raises the count of each executed block in offsets
+// to the highest count of the blocks within the same block statement or
+// case clause of f. A loop body runs more often than the statements
+// around the loop, and those must be kept with it: they declare what the
+// body uses and return what it computes. Blocks not executed at all are
+// left alone.
+func raiseEnclosingCounts(fset *token.FileSet, f *ast.File, offsets []Uncovered) {
+	type span struct{ pos, end int }
+	innermost := make([]span, len(offsets))
+	highest := make(map[span]int)
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.BlockStmt, *ast.CaseClause, *ast.CommClause:
+		default:
+			return true
+		}
+		s := span{fset.Position(n.Pos()).Offset, fset.Position(n.End()).Offset}
+		for i, off := range offsets {
+			if off.Pos >= s.pos && off.End <= s.end {
+				// Blocks are visited outside in.
+				innermost[i] = s
+				if off.Count > highest[s] {
+					highest[s] = off.Count
+				}
+			}
+		}
+		return true
+	})
+	for i := range offsets {
+		if c := highest[innermost[i]]; offsets[i].Count > 0 && c > offsets[i].Count {
+			offsets[i].Count = c
+		}
+	}
 }
 
 func (c Uncovered) Match(fset *token.FileSet, n ast.Node) bool {
@@ -100,12 +198,19 @@ func (c Uncovered) Match(fset *token.FileSet, n ast.Node) bool {
 }
 
 type StmtPruner struct {
-	fset    *token.FileSet
-	offsets []Uncovered
+	fset     *token.FileSet
+	offsets  []Uncovered
+	minCount int
+
+	removed  []ast.Node      // removed statements and declarations
+	emptied  []*ast.FuncDecl // functions all the statements were removed from
+	returned []*ast.FuncDecl // functions a return was added to
 }
 
-func NewStmtPruner(fset *token.FileSet, offsets []Uncovered) *StmtPruner {
-	return &StmtPruner{fset, offsets}
+// NewStmtPruner returns a pruner removing the statements of the blocks
+// executed fewer than minCount times.
+func NewStmtPruner(fset *token.FileSet, offsets []Uncovered, minCount int) *StmtPruner {
+	return &StmtPruner{fset, offsets, minCount, nil, nil, nil}
 }
 
 func (sp *StmtPruner) Update(node ast.Node) ast.Node {
@@ -116,8 +221,10 @@ func (sp *StmtPruner) Update(node ast.Node) ast.Node {
 	case *ast.File:
 		var newDecls []ast.Decl
 		for _, decl := range n.Decls {
-			if decl := sp.Update(decl); decl != nil {
-				newDecls = append(newDecls, decl.(ast.Decl))
+			if d := sp.Update(decl); d != nil {
+				newDecls = append(newDecls, d.(ast.Decl))
+			} else {
+				sp.removed = append(sp.removed, decl)
 			}
 		}
 		if len(newDecls) == 0 {
@@ -135,6 +242,7 @@ func (sp *StmtPruner) Update(node ast.Node) ast.Node {
 			// the function in order not to break possible interfaces.
 			n.Body.List = nil
 			fixReturn = true
+			sp.emptied = append(sp.emptied, n)
 		} else {
 			lastStmt := n.Body.List[len(n.Body.List)-1]
 			if _, ok := lastStmt.(*ast.ReturnStmt); !ok {
@@ -154,6 +262,7 @@ func (sp *StmtPruner) Update(node ast.Node) ast.Node {
 				index++
 			}
 			n.Body.List = append(n.Body.List, &ast.ReturnStmt{})
+			sp.returned = append(sp.returned, n)
 		}
 		if n.Body == nil {
 			panic("body shoudn't be nil")
@@ -161,8 +270,10 @@ func (sp *StmtPruner) Update(node ast.Node) ast.Node {
 	case *ast.BlockStmt:
 		var newBlStmts []ast.Stmt
 		for _, stmt := range n.List {
-			if stmt := sp.Update(stmt); stmt != nil {
-				newBlStmts = append(newBlStmts, stmt.(ast.Stmt))
+			if s := sp.Update(stmt); s != nil {
+				newBlStmts = append(newBlStmts, s.(ast.Stmt))
+			} else {
+				sp.removed = append(sp.removed, stmt)
 			}
 		}
 		if len(newBlStmts) == 0 {
@@ -196,8 +307,10 @@ func (sp *StmtPruner) Update(node ast.Node) ast.Node {
 	case *ast.CaseClause:
 		var newBlStmts []ast.Stmt
 		for _, stmt := range n.Body {
-			if stmt := sp.Update(stmt); stmt != nil {
-				newBlStmts = append(newBlStmts, stmt.(ast.Stmt))
+			if s := sp.Update(stmt); s != nil {
+				newBlStmts = append(newBlStmts, s.(ast.Stmt))
+			} else {
+				sp.removed = append(sp.removed, stmt)
 			}
 		}
 		if len(newBlStmts) == 0 {
@@ -226,7 +339,7 @@ func (sp *StmtPruner) Update(node ast.Node) ast.Node {
 
 func (sp *StmtPruner) ShouldRemove(node ast.Node) bool {
 	for _, p := range sp.offsets {
-		if p.Match(sp.fset, node) {
+		if p.Count < sp.minCount && p.Match(sp.fset, node) {
 			return true
 		}
 	}
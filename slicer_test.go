@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+func TestFindOffsets(t *testing.T) {
+	src := []byte("package p\n\nvar s = \"žluťoučký\"\nvar x = 1\n")
+	fset := token.NewFileSet()
+	f := fset.AddFile("p.go", -1, len(src))
+	f.SetLinesForContent(src)
+
+	tests := []struct {
+		rem        CoverPos
+		off0, off1 int
+		ok         bool
+	}{
+		{CoverPos{1, 1, 1, 9}, 0, 9, true},
+		{CoverPos{3, 1, 4, 9}, 11, 44, true},
+		{CoverPos{4, 1, 4, 10}, 35, 45, true}, // column of the newline
+		{CoverPos{4, 1, 4, 11}, 0, 0, false},
+		{CoverPos{3, 11, 3, 12}, 0, 0, false}, // inside 'ž'
+		{CoverPos{5, 1, 5, 2}, 0, 0, false},
+		{CoverPos{2, 2, 2, 2}, 0, 0, false},
+		{CoverPos{4, 5, 4, 1}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		off0, off1, err := findOffsets(f, src, tt.rem)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: unexpected error value: %v", tt.rem, err)
+			continue
+		}
+		if off0 != tt.off0 || off1 != tt.off1 {
+			t.Errorf("%v: got %d,%d, want %d,%d", tt.rem, off0, off1, tt.off0, tt.off1)
+		}
+	}
+}
+
+func TestStmtPrunerMinCount(t *testing.T) {
+	src := "package p\n\nfunc f(x int) int {\n\tx++\n\tif x > 0 {\n\t\tx--\n\t}\n\treturn x\n}\n"
+	for _, tt := range []struct {
+		minCount int
+		removed  bool
+	}{
+		{1, false},
+		{3, false},
+		{4, true},
+	} {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "p.go", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The body of the if statement, executed 3 times.
+		pos := strings.Index(src, "x--")
+		sp := NewStmtPruner(fset, []Uncovered{{pos, pos + len("x--") + 1, 3}}, tt.minCount)
+		sp.Update(f)
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, fset, f); err != nil {
+			t.Fatal(err)
+		}
+		if removed := !strings.Contains(buf.String(), "x--"); removed != tt.removed {
+			t.Errorf("min count %d: removed = %v, want %v:\n%s", tt.minCount, removed, tt.removed, buf.String())
+		}
+	}
+}
+
+func TestStmtPrunerHotLoop(t *testing.T) {
+	src := "package p\n\nfunc sum(xs []int) int {\n\ts := 0\n\tfor _, x := range xs {\n\t\ts += x\n\t}\n\treturn s\n}\n\nfunc g() {\n\tprintln()\n}\n"
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "p.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := func(from, to string, count int) Uncovered {
+		pos := strings.Index(src, from)
+		return Uncovered{pos, strings.Index(src, to) + len(to) + 1, count}
+	}
+	// The function is called once, its loop body runs 20 times.
+	offsets := []Uncovered{
+		block("s := 0", "range xs {", 1),
+		block("s += x", "s += x", 20),
+		block("return s", "return s", 1),
+		block("println()", "println()", 1),
+	}
+	raiseEnclosingCounts(fset, f, offsets)
+	NewStmtPruner(fset, offsets, 10).Update(f)
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"s := 0", "s += x", "return s"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("%q removed:\n%s", s, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "println()") {
+		t.Errorf("cold function kept:\n%s", buf.String())
+	}
+}
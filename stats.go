@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// origPackage is the program in the workspace built against the original
+// packages to compare its size with the sliced program. It's as long as
+// dstPackage so that the paths in the binaries don't skew the sizes.
+const origPackage = "intact"
+
+// fileStats are the figures of slicing a file.
+type fileStats struct {
+	pkg         string // import path of the package
+	origLines   int
+	slicedLines int // 0 if the file was removed
+
+	// Removed code.
+	stmts, funcs, types, fields int
+
+	fixes int // times the Fixer fixed the file
+}
+
+// sliceStats are the figures of the files sliced in a run, by the
+// absolute paths of the sliced files, and of the whole run.
+var sliceStats = struct {
+	sync.Mutex
+	files    map[string]*fileStats
+	fixRuns  int   // iterations of fixing the sliced packages
+	origSize int64 // size of the usage programs built against the originals
+	size     int64 // size of the sliced usage programs
+
+	// Sizes of the symbols of the programs, with -size-report.
+	origSyms, syms map[string]int64
+}{files: make(map[string]*fileStats)}
+
+func resetStats() {
+	sliceStats.Lock()
+	sliceStats.files = make(map[string]*fileStats)
+	sliceStats.fixRuns = 0
+	sliceStats.origSize, sliceStats.size = -1, -1
+	sliceStats.origSyms, sliceStats.syms = nil, nil
+	sliceStats.Unlock()
+}
+
+// registerStats sets the figures of the sliced file filename to st.
+func registerStats(filename string, st *fileStats) {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	sliceStats.Lock()
+	sliceStats.files[filename] = st
+	sliceStats.Unlock()
+}
+
+// fileStatsOf returns the figures of the sliced file filename, or a
+// throwaway value if the file isn't sliced, such as a usage program.
+func fileStatsOf(filename string) *fileStats {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	sliceStats.Lock()
+	defer sliceStats.Unlock()
+	if st := sliceStats.files[filename]; st != nil {
+		return st
+	}
+	return new(fileStats)
+}
+
+// countRemoved adds the statements, functions, types and struct fields
+// within the removed nodes to st.
+func (st *fileStats) countRemoved(removed []ast.Node) {
+	for _, n := range outermost(removed) {
+		if _, ok := n.(*ast.Field); ok {
+			st.fields++
+		}
+		ast.Inspect(n, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncDecl:
+				st.funcs++
+			case *ast.TypeSpec:
+				st.types++
+			case *ast.StructType:
+				st.fields += len(n.Fields.List)
+			case *ast.BlockStmt:
+			case ast.Stmt:
+				st.stmts++
+			}
+			return true
+		})
+	}
+}
+
+// countSlicedLines sets the line counts of the sliced files as they are
+// after the pruning. It must be called before the //line directives are
+// inserted; the markers of removed code aren't counted either.
+func countSlicedLines() error {
+	sliceStats.Lock()
+	defer sliceStats.Unlock()
+	for filename, st := range sliceStats.files {
+		b, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			st.slicedLines = 0
+			continue
+		} else if err != nil {
+			return err
+		}
+		st.slicedLines = countLines(b)
+	}
+	return nil
+}
+
+// countLines returns the number of lines of src except for the markers.
+func countLines(src []byte) int {
+	n := 0
+	for _, l := range bytes.SplitAfter(src, []byte("\n")) {
+		if len(l) > 0 && !isMarker(string(bytes.TrimSpace(l))) {
+			n++
+		}
+	}
+	return n
+}
+
+// compareSizes builds the usage programs of the runs for the host against
+// the original and against the sliced packages and records the total
+// sizes of the binaries and, with -size-report, the sizes of their
+// symbols. A size stays unknown if a program doesn't build.
+func compareSizes(results []*CoverResult, runs []*tmplRun) error {
+	origDir := filepath.Join(*workspace, "src", origPackage)
+	if err := os.RemoveAll(origDir); err != nil {
+		return err
+	}
+	for _, cr := range results {
+		path, err := slicedPath(cr)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(origDir, "vendor", path)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(dst, cr.Filename); err != nil {
+			return err
+		}
+	}
+	if _, err := copyNonGoFiles(origDir, results); err != nil {
+		return err
+	}
+	var origDirs, dirs []string
+	for i, run := range runs {
+		dir := filepath.Join(*workspace, "src", filepath.FromSlash(progPath(origPackage, i, len(runs))))
+		if _, err := run.tp.WriteProgram(dir, genMainData(run.tp, run.fn, nil, nil, "")); err != nil {
+			return err
+		}
+		origDirs = append(origDirs, dir)
+		dirs = append(dirs, filepath.Join(*workspace, "src", filepath.FromSlash(progPath(dstPackage, i, len(runs)))))
+	}
+	origSize, origBins := buildSize(origDirs)
+	size, bins := buildSize(dirs)
+	sliceStats.Lock()
+	sliceStats.origSize, sliceStats.size = origSize, size
+	sliceStats.Unlock()
+	if *sizeReport == 0 || origSize < 0 || size < 0 {
+		return nil
+	}
+	origSyms, err := symbolSizes(origBins)
+	if err != nil {
+		return err
+	}
+	syms, err := symbolSizes(bins)
+	if err != nil {
+		return err
+	}
+	sliceStats.Lock()
+	sliceStats.origSyms, sliceStats.syms = origSyms, syms
+	sliceStats.Unlock()
+	return nil
+}
+
+// buildSize builds the programs in dirs for the host and returns the
+// total size of the binaries and the binaries. The size is -1 if any of
+// the programs doesn't build.
+func buildSize(dirs []string) (int64, []string) {
+	var total int64
+	var bins []string
+	for _, dir := range dirs {
+		bin, err := buildProg(dir, nil, hostPlatform)
+		if err != nil {
+			Verbosef("%v", err)
+			return -1, nil
+		}
+		fi, err := os.Stat(bin)
+		if err != nil {
+			return -1, nil
+		}
+		total += fi.Size()
+		bins = append(bins, bin)
+	}
+	return total, bins
+}
+
+// printStats writes the figures of the run to w as a table of the
+// sliced packages and their files.
+func printStats(w io.Writer) {
+	sliceStats.Lock()
+	defer sliceStats.Unlock()
+	type fileRow struct {
+		name string
+		st   *fileStats
+	}
+	pkgs := make(map[string][]fileRow)
+	for filename, st := range sliceStats.files {
+		pkgs[st.pkg] = append(pkgs[st.pkg], fileRow{filepath.Base(filename), st})
+	}
+	paths := make([]string, 0, len(pkgs))
+	for path := range pkgs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE/FILE\tLINES\tSLICED\tSTMTS\tFUNCS\tTYPES\tFIELDS\tFIXES")
+	row := func(name string, st *fileStats) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", name, st.origLines, st.slicedLines,
+			st.stmts, st.funcs, st.types, st.fields, st.fixes)
+	}
+	add := func(sum, st *fileStats) {
+		sum.origLines += st.origLines
+		sum.slicedLines += st.slicedLines
+		sum.stmts += st.stmts
+		sum.funcs += st.funcs
+		sum.types += st.types
+		sum.fields += st.fields
+		sum.fixes += st.fixes
+	}
+	var total fileStats
+	for _, path := range paths {
+		files := pkgs[path]
+		sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+		var sum fileStats
+		for _, f := range files {
+			add(&sum, f.st)
+		}
+		row(path, &sum)
+		for _, f := range files {
+			row("  "+f.name, f.st)
+		}
+		add(&total, &sum)
+	}
+	row("total", &total)
+	tw.Flush()
+
+	fmt.Fprintf(w, "Fixer iterations: %d\n", sliceStats.fixRuns)
+	if sliceStats.origSize >= 0 && sliceStats.size >= 0 {
+		diff := sliceStats.size - sliceStats.origSize
+		fmt.Fprintf(w, "Binary size: %d -> %d bytes (%+d, %+.1f%%)\n", sliceStats.origSize, sliceStats.size,
+			diff, 100*float64(diff)/float64(sliceStats.origSize))
+	} else if *binarySize || *sizeReport > 0 {
+		// The sizes were requested but couldn't be measured.
+		fmt.Fprintln(w, "Binary size: unknown")
+	}
+	if sliceStats.origSyms != nil {
+		fmt.Fprintln(w)
+		printSizeReport(w, sliceStats.origSyms, sliceStats.syms, *sizeReport)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+func TestCountRemoved(t *testing.T) {
+	const src = `package p
+
+type T struct {
+	A, B int
+	C    struct{ D int }
+}
+
+type U int
+
+func F() {
+	if true {
+		println()
+	}
+}
+`
+	f, err := parser.ParseFile(token.NewFileSet(), "p.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := f.Decls[0].(*ast.GenDecl).Specs[0].(*ast.TypeSpec)
+	fd := f.Decls[2].(*ast.FuncDecl)
+	ifStmt := fd.Body.List[0].(*ast.IfStmt)
+	removed := []ast.Node{
+		ts.Type.(*ast.StructType).Fields.List[1],
+		f.Decls[1],
+		ifStmt.Body.List[0],
+		ifStmt,
+		fd,
+	}
+	var st fileStats
+	st.countRemoved(removed)
+	want := fileStats{stmts: 2, funcs: 1, types: 1, fields: 2}
+	if st != want {
+		t.Errorf("got %+v, want %+v", st, want)
+	}
+}
+
+func TestCountLines(t *testing.T) {
+	for src, want := range map[string]int{
+		"":                       0,
+		"package p\n":            1,
+		"package p\n\nvar x int": 3,
+		"package p\n\nfunc f() {\n\t" + markerPrefix + "1 line (p.go:4)\n}\n": 4,
+	} {
+		if got := countLines([]byte(src)); got != want {
+			t.Errorf("countLines(%q) = %d, want %d", src, got, want)
+		}
+	}
+}
+
+func TestPrintStatsSize(t *testing.T) {
+	defer func(old bool) { *binarySize = old }(*binarySize)
+	defer resetStats()
+	resetStats()
+	for _, tt := range []struct {
+		requested      bool
+		origSize, size int64
+		want           string
+	}{
+		{false, -1, -1, ""},
+		{true, -1, -1, "Binary size: unknown\n"},
+		{true, 200, 150, "Binary size: 200 -> 150 bytes (-50, -25.0%)\n"},
+	} {
+		*binarySize = tt.requested
+		sliceStats.origSize, sliceStats.size = tt.origSize, tt.size
+		var buf bytes.Buffer
+		printStats(&buf)
+		got := ""
+		if i := strings.Index(buf.String(), "Binary size"); i >= 0 {
+			got = buf.String()[i:]
+		}
+		if got != tt.want {
+			t.Errorf("requested %v, sizes %d, %d: got %q, want %q", tt.requested, tt.origSize, tt.size, got, tt.want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"strconv"
 	"text/template"
 )
 
@@ -22,16 +23,31 @@ func (imps *Imports) Append(name, path string) {
 	*imps = append(*imps, imp{name, path})
 }
 
-func (imps Imports) CopyWithFmt() Imports {
+// WithAliases returns a copy of imps in which every import has a name
+// that differs from the names of the other imports and from the names
+// in taken. The package name is kept whenever possible.
+func (imps Imports) WithAliases(taken map[string]bool) Imports {
+	used := make(map[string]bool)
+	aliased := make(Imports, 0, len(imps))
 	for _, im := range imps {
-		if im.Path == "fmt" {
-			// TODO: fmt is indeed imported, but the
-			// local name could be different.
-			return imps
+		name := im.Name
+		for i := 1; taken[name] || used[name]; i++ {
+			name = im.Name + strconv.Itoa(i)
 		}
+		used[name] = true
+		aliased.Append(name, im.Path)
 	}
-	imps.Append("", "fmt")
-	return imps
+	return aliased
+}
+
+// Name returns the local name of the package imported from path.
+func (imps Imports) Name(path string) string {
+	for _, im := range imps {
+		if im.Path == path {
+			return im.Name
+		}
+	}
+	return ""
 }
 
 func (imps Imports) Paths() []string {
@@ -59,37 +75,132 @@ type imp struct {
 
 type TemplateStruct struct {
 	Imports string
-	Func    string
-	Name    string
-	Files   []CoverFile
+	Fmt     string // local name of package fmt
+	Os      string // local name of package os
+	Signal  string // local name of package os/signal
+	Syscall string // local name of package syscall
+	Testing string // local name of package testing
+	Flag    string // local name of package flag
+	Atomic  string // local name of package sync/atomic, if counters are atomic
+	Context string // local name of package context
+	SIGXCPU bool   // whether to write the data on SIGXCPU too
+	Out     string // file for the coverage data
+
+	Name     string // name of the slice function
+	Param    string // type of its parameter
+	Deadline int64  // deadline of its context in nanoseconds, if non-zero
+	Files    []CoverFile
 }
 
 type CoverFile struct {
-	Package string
+	Package string // local name of the package
+	Path    string // import path of the package
 	Name    string
 	Var     string
 }
 
+// genMainImports are the packages imported by the generated main function
+// of the coverage program.
+var genMainImports = []string{"fmt", "os", "os/signal", "syscall"}
+
+// genMainLocals are the local variables of the generated main function.
+// Package names used in the function mustn't be shadowed by them.
+var genMainLocals = []string{"sem", "dump", "sig", "s", "out", "err", "i", "cnt", "line0", "col0", "line1", "col1", "ctx", "cancel", "match", "t"}
+
+// sliceTmpl is the main function of the generated programs. In the
+// coverage program, the coverage data is written either when the slice
+// function returns or when the program receives SIGTERM (or SIGXCPU),
+// whichever comes first, so that a run stopped for exceeding a limit
+// still provides partial coverage.
 var sliceTmpl = template.Must(template.New("main").Parse(`package main
 
 {{ .Imports }}
 
 func main() {
-	{{ .Name }}()
-	{{ range .Files }}
-	fmt.Println({{ .Name | printf "%q" }})
-	for i, cnt := range {{ .Package }}.{{ .Var }}.Count {
-		if cnt > 0 {
-			continue
+	{{ if .Files }}
+	sem := make(chan bool, 1)
+	sem <- true
+	dump := func() bool {
+		select {
+		case <-sem:
+		default:
+			return false
+		}
+		out, err := {{ .Os }}.Create({{ .Out | printf "%q" }})
+		if err != nil {
+			panic(err)
+		}
+		defer out.Close()
+		{{ range .Files }}
+		{{ $.Fmt }}.Fprintln(out, {{ .Name | printf "%q" }})
+		for i := range {{ .Package }}.{{ .Var }}.Count {
+			{{ if $.Atomic -}}
+			cnt := {{ $.Atomic }}.LoadUint32(&{{ .Package }}.{{ .Var }}.Count[i])
+			{{- else -}}
+			cnt := {{ .Package }}.{{ .Var }}.Count[i]
+			{{- end }}
+			line0 := {{ .Package }}.{{ .Var }}.Pos[i*3+0]
+			col0 := uint16({{ .Package }}.{{ .Var }}.Pos[i*3+2])
+			line1 := {{ .Package }}.{{ .Var }}.Pos[i*3+1]
+			col1 := uint16({{ .Package }}.{{ .Var }}.Pos[i*3+2] >> 16)
+			if cnt == 0 {
+				{{ $.Fmt }}.Fprintf(out, "#%d:%d,%d:%d\n", line0, col0, line1, col1)
+			} else {
+				{{ $.Fmt }}.Fprintf(out, "+%d:%d,%d:%d %d\n", line0, col0, line1, col1, cnt)
+			}
 		}
-		line0 := {{ .Package }}.{{ .Var }}.Pos[i*3+0]
-		col0 := uint16({{ .Package }}.{{ .Var }}.Pos[i*3+2])
-		line1 := {{ .Package }}.{{ .Var }}.Pos[i*3+1]
-		col1 := uint16({{ .Package }}.{{ .Var }}.Pos[i*3+2] >> 16)
-		fmt.Printf("#%d:%d,%d:%d\n", line0, col0, line1, col1)
+		{{ end }}
+		return true
 	}
+	sig := make(chan {{ .Os }}.Signal, 1)
+	{{ .Signal }}.Notify(sig, {{ .Syscall }}.SIGTERM{{ if .SIGXCPU }}, {{ .Syscall }}.SIGXCPU{{ end }})
+	go func() {
+		{{ if .SIGXCPU }}s := <-sig{{ else }}<-sig{{ end }}
+		if dump() {
+			{{ if .SIGXCPU }}
+			if s == {{ .Syscall }}.SIGXCPU {
+				// Die of a signal the way the hard limit kills
+				// the program, telling that the limit stopped it.
+				{{ .Syscall }}.Kill({{ .Syscall }}.Getpid(), {{ .Syscall }}.SIGKILL)
+			}
+			{{ end }}
+			{{ .Os }}.Exit(1)
+		}
+		// The slice function has just returned and main is
+		// writing the data.
+		select {}
+	}()
+	{{ end }}
+	{{ if eq .Param "*testing.T" }}
+	// Leave the arguments to the program; testing.Main would
+	// parse them otherwise.
+	{{ .Flag }}.CommandLine.Parse(nil)
+	match := func(_, _ string) (bool, error) { return true, nil }
+	// testing.Main exits, so the coverage data is written
+	// as soon as the test finishes.
+	{{ .Testing }}.Main(match, []{{ .Testing }}.InternalTest{ {
+		Name: {{ .Name | printf "%q" }},
+		F: func(t *{{ .Testing }}.T) {
+			{{ if .Files }}t.Cleanup(func() { dump() }){{ end }}
+			{{ .Name }}(t)
+		},
+	} }, nil, nil)
+	{{ else if eq .Param "*testing.B" }}
+	{{ .Testing }}.Init()
+	{{ .Testing }}.Benchmark({{ .Name }})
+	{{ else if eq .Param "context.Context" }}
+	{{ if .Deadline }}
+	ctx, cancel := {{ .Context }}.WithTimeout({{ .Context }}.Background(), {{ .Deadline }})
+	{{ else }}
+	ctx, cancel := {{ .Context }}.WithCancel({{ .Context }}.Background())
+	{{ end }}
+	{{ .Name }}(ctx)
+	cancel()
+	{{ else }}
+	{{ .Name }}()
+	{{ end }}
+	{{ if .Files }}
+	dump()
 	{{ end }}
 }
-
-{{ .Func }}
 `))
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// genMainFile is the name of the file with the generated main function
+// that is added to the template package.
+const genMainFile = "slicer_main.go"
+
+// TmplPkg is a template: a main package with a Slice function. It can
+// consist of a single file or of a whole directory including testdata.
+type TmplPkg struct {
+	Dir   string
+	Files []string // Go files, relative to Dir
+
+	single bool // whether the template is a single file
+	fset   *token.FileSet
+	asts   []*ast.File
+}
+
+// loadTmplPkg loads the template given either as a Go file, a directory
+// or an import path.
+func loadTmplPkg(arg string) (*TmplPkg, error) {
+	tp := &TmplPkg{fset: token.NewFileSet()}
+	fi, err := os.Stat(arg)
+	switch {
+	case err == nil && !fi.IsDir():
+		tp.Dir = filepath.Dir(arg)
+		tp.Files = []string{filepath.Base(arg)}
+		tp.single = true
+	case err == nil:
+		p, err := build.ImportDir(arg, 0)
+		if err != nil {
+			return nil, err
+		}
+		tp.Dir = p.Dir
+		tp.Files = p.GoFiles
+	default:
+		p, err := build.Import(arg, ".", 0)
+		if err != nil {
+			return nil, err
+		}
+		tp.Dir = p.Dir
+		tp.Files = p.GoFiles
+	}
+
+	for _, name := range tp.Files {
+		if name == genMainFile {
+			return nil, fmt.Errorf("%s: file name reserved for the generated main function", filepath.Join(tp.Dir, name))
+		}
+		f, err := parser.ParseFile(tp.fset, filepath.Join(tp.Dir, name), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if f.Name.Name != "main" {
+			return nil, fmt.Errorf("%s: template must be in package main, not %s", tp.fset.Position(f.Name.Pos()), f.Name.Name)
+		}
+		tp.asts = append(tp.asts, f)
+	}
+	if len(tp.asts) == 0 {
+		return nil, fmt.Errorf("no Go files in template %s", arg)
+	}
+	return tp, checkTemplateDecls(tp.fset, tp.asts)
+}
+
+// ImportPaths returns the paths of the packages imported by any file
+// of the template, in the order of their first appearance.
+func (tp *TmplPkg) ImportPaths() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, f := range tp.asts {
+		for _, im := range f.Imports {
+			path, err := strconv.Unquote(im.Path.Value)
+			if err != nil {
+				panic("invalid quoted string returned by parser")
+			}
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// SliceFunc is the function of the template that drives the slicing.
+type SliceFunc struct {
+	Name  string
+	Param string // type of the parameter, one of sliceParams, or ""
+}
+
+// sliceParams maps the supported parameter types of slice functions
+// to the packages declaring them.
+var sliceParams = map[string]string{
+	"*testing.T":      "testing",
+	"*testing.B":      "testing",
+	"context.Context": "context",
+}
+
+// ParamPkg returns the import path of the package of the parameter type.
+func (sf SliceFunc) ParamPkg() string {
+	return sliceParams[sf.Param]
+}
+
+// SliceFunc returns the first function of the form func SliceXxx(),
+// func SliceXxx(*testing.T), func SliceXxx(*testing.B) or
+// func SliceXxx(context.Context).
+func (tp *TmplPkg) SliceFunc() (SliceFunc, error) {
+	for _, f := range tp.asts {
+		for _, decl := range f.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || !strings.HasPrefix(fd.Name.Name, "Slice") ||
+				fd.Recv != nil || fd.Type.Results != nil {
+				continue
+			}
+			param, ok := sliceParam(f, fd.Type.Params)
+			if !ok {
+				continue
+			}
+			// TODO: Add support for multiple functions.
+			return SliceFunc{fd.Name.Name, param}, nil
+		}
+	}
+	return SliceFunc{}, fmt.Errorf("%s: no Slice function found", tp.Dir)
+}
+
+// sliceParam returns the parameter type of a slice function declared
+// in f with the parameters params. It reports whether the parameters
+// are supported.
+func sliceParam(f *ast.File, params *ast.FieldList) (string, bool) {
+	switch {
+	case params.NumFields() == 0:
+		return "", true
+	case params.NumFields() > 1:
+		return "", false
+	}
+	typ := params.List[0].Type
+	star := ""
+	if se, ok := typ.(*ast.StarExpr); ok {
+		typ = se.X
+		star = "*"
+	}
+	sel, ok := typ.(*ast.SelectorExpr)
+	if !ok {
+		return "", false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return "", false
+	}
+	// Resolve the package name using the imports of the file.
+	for _, im := range f.Imports {
+		path, err := strconv.Unquote(im.Path.Value)
+		if err != nil {
+			panic("invalid quoted string returned by parser")
+		}
+		name := filepath.Base(path)
+		if im.Name != nil {
+			name = im.Name.Name
+		}
+		if name != x.Name {
+			continue
+		}
+		param := star + filepath.Base(path) + "." + sel.Sel.Name
+		if sliceParams[param] == path {
+			return param, true
+		}
+	}
+	return "", false
+}
+
+// Idents returns the package-level identifiers declared by the template.
+func (tp *TmplPkg) Idents() map[string]bool {
+	idents := make(map[string]bool)
+	for _, f := range tp.asts {
+		for name := range f.Scope.Objects {
+			idents[name] = true
+		}
+	}
+	return idents
+}
+
+// Inputs returns the paths of all the files of the template. Only
+// directory templates include testdata.
+func (tp *TmplPkg) Inputs() []string {
+	var inputs []string
+	for _, name := range tp.Files {
+		inputs = append(inputs, filepath.Join(tp.Dir, name))
+	}
+	if tp.single {
+		return inputs
+	}
+	return append(inputs, tp.testdata()...)
+}
+
+func (tp *TmplPkg) testdata() []string {
+	var files []string
+	filepath.Walk(filepath.Join(tp.Dir, "testdata"), func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+// WriteProgram copies the template to dir and adds the generated main
+// function to it. It returns the names of the Go files of the program.
+func (tp *TmplPkg) WriteProgram(dir string, ts TemplateStruct) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, path := range tp.Inputs() {
+		rel, err := filepath.Rel(tp.Dir, path)
+		if err != nil {
+			return nil, err
+		}
+		dst := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, err
+		}
+		if err := copyFile(dst, path); err != nil {
+			return nil, err
+		}
+	}
+	mainFile := filepath.Join(dir, genMainFile)
+	if err := WriteTmplToFile(mainFile, ts); err != nil {
+		return nil, fmt.Errorf("writing template %s: %v", mainFile, err)
+	}
+	return append(append([]string(nil), tp.Files...), genMainFile), nil
+}
+
+// genMainReserved are the package-level names the generated main
+// function depends on: its own name and the predeclared identifiers
+// it uses.
+var genMainReserved = map[string]bool{
+	"main":   true,
+	"bool":   true,
+	"error":  true,
+	"false":  true,
+	"make":   true,
+	"nil":    true,
+	"panic":  true,
+	"string": true,
+	"true":   true,
+	"uint16": true,
+}
+
+// checkTemplateDecls checks that no package-level declaration
+// of the template files collides with or shadows a name the generated
+// main function depends on.
+func checkTemplateDecls(fset *token.FileSet, files []*ast.File) error {
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			var names []*ast.Ident
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.ValueSpec:
+						names = append(names, s.Names...)
+					case *ast.TypeSpec:
+						names = append(names, s.Name)
+					}
+				}
+			case *ast.FuncDecl:
+				if d.Recv == nil {
+					names = append(names, d.Name)
+				}
+			}
+			for _, id := range names {
+				if genMainReserved[id.Name] {
+					return fmt.Errorf("%s: %s collides with a name the generated main function depends on",
+						fset.Position(id.Pos()), id.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func copyFile(dst, src string) error {
+	df, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	_, err = io.Copy(df, sf)
+	return err
+}
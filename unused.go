@@ -1,116 +1,124 @@
 package main
 
 import (
+	"fmt"
 	"go/ast"
 	"go/build"
 	"go/parser"
-	"go/printer"
 	"go/token"
 	"go/types"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"honnef.co/go/unused"
 )
 
-func pruneUnusedObjs(workspace string, packages []string) {
+// pruneUnusedObjs removes the objects of the sliced packages that the
+// packages don't use on any of the target platforms.
+func pruneUnusedObjs(workspace string, packages []string) error {
 	ch := unused.NewChecker(unused.CheckAll)
 	ch.WholeProgram = true
 
 	gopath, err := filepath.Abs(workspace)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer func(old build.Context) { build.Default = old }(build.Default)
 	build.Default.GOPATH = gopath
 
 	// For unused.Checker it is important to be in the package directory
 	// in order to recognise vendored packages.
 	wd, err := os.Getwd()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if err := os.Chdir(filepath.Join(workspace, "src", dstPackage)); err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer os.Chdir(wd)
 
-	var us []unused.Unused
-	for i := 0; i < 15; i++ { // Don't loop forever.
-		us, err = ch.Check(packages)
-		if err == nil {
-			break
+	// Fixing the files for a platform invalidates the positions reported
+	// for the platforms checked before, so check them all again then.
+	plats := targetPlatforms()
+	var reports [][]unused.Unused
+	for i := 0; ; i++ {
+		if i == 15 { // Don't loop forever.
+			return fmt.Errorf("checking unused packages: the files keep changing")
 		}
-
-		// Program slicing can make resulting programs invalid (because
-		// of unused imports or variables). Try to fix it.
-		if errs, ok := err.(unused.Error); ok {
-			invalid := make(map[token.Pos]*token.FileSet)
-			isSerious := false
-			for p, errs := range errs.Errors {
-				for _, err := range errs {
-					if terr, ok := err.(types.Error); ok {
-						invalid[terr.Pos] = terr.Fset
-						continue
-					}
-					// If there are other error types, report them
-					// and exit afterwards.
-					log.Printf("%s: %v", p, err)
-					isSerious = true
-				}
-			}
-			if !isSerious {
-				files := make(map[string][]int)
-				for p, fset := range invalid {
-					f := fset.File(p)
-					files[f.Name()] = append(files[f.Name()], f.Position(p).Offset)
-				}
-				for f, offs := range files {
-					Verbosef("Fixing: %s @ %v", f, offs)
-					fix(f, offs)
-				}
-				continue
+		reports = reports[:0]
+		stale := false
+		for j, pl := range plats {
+			build.Default = pl.context()
+			us, fixed, err := checkUnused(ch, packages)
+			if err != nil {
+				return err
 			}
+			stale = stale || fixed && j > 0
+			reports = append(reports, us)
+		}
+		if !stale {
+			break
 		}
-		log.Fatalf("Checking unused packages: %v", err)
 	}
 
+	reported := make([]map[objPos]bool, len(reports))
+	for i, us := range reports {
+		reported[i] = make(map[objPos]bool)
+		for _, u := range us {
+			reported[i][objPos{u.Position.Filename, u.Position.Offset}] = true
+		}
+	}
 	unused := map[string][]Unused{}
-	for _, u := range us {
-		Verbosef("%s:#%d (%T)\n", u.Position.Filename, u.Position.Offset, u.Obj)
-		unused[u.Position.Filename] = append(unused[u.Position.Filename], Unused{u.Obj, u.Position.Offset})
+	seen := make(map[objPos]bool)
+	for _, us := range reports {
+		for _, u := range us {
+			k := objPos{u.Position.Filename, u.Position.Offset}
+			if seen[k] || !unusedOnAll(plats, reported, k) {
+				continue
+			}
+			seen[k] = true
+			Verbosef("%s:#%d (%T)\n", u.Position.Filename, u.Position.Offset, u.Obj)
+			unused[u.Position.Filename] = append(unused[u.Position.Filename], Unused{u.Obj, u.Position.Offset})
+		}
 	}
 	Verbosef("")
 
 	Verbosef("Pruning unused objects")
-	for file, us := range unused {
-		pruneFileUnused(file, us)
+	files := make([]string, 0, len(unused))
+	for file := range unused {
+		files = append(files, file)
 	}
+	sort.Strings(files)
+	return forEach(len(files), func(i int) error {
+		return pruneFileUnused(files[i], unused[files[i]])
+	})
 }
 
-func pruneFileUnused(filename string, us []Unused) {
+func pruneFileUnused(filename string, us []Unused) error {
 	Verbosef("Pruning %s", filename)
 	fset := token.NewFileSet()
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	fileAST, err := parser.ParseFile(fset, filename, b, 0)
+	fileAST, err := parser.ParseFile(fset, filename, b, parser.ParseComments)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	op := NewObjPruner(fset, us)
+	syms := declaredSymbols(fileAST)
 	op.Update(fileAST)
-	f, err := os.Create(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-	if err := printer.Fprint(f, fset, fileAST); err != nil {
-		log.Fatal(err)
+	recordObjPruning(filename, syms, op.removed)
+	fileStatsOf(filename).countRemoved(op.removed)
+	keepDirectives(fileAST)
+	if *markers {
+		markRemoved(fset, fileAST, b, op.removed)
 	}
+	return writeSliced(filename, fset, fileAST)
 }
 
 type Unused struct {
@@ -121,10 +129,12 @@ type Unused struct {
 type ObjPruner struct {
 	fset   *token.FileSet
 	unused []Unused
+
+	removed []ast.Node // removed declarations, specs and fields
 }
 
 func NewObjPruner(fset *token.FileSet, unused []Unused) *ObjPruner {
-	return &ObjPruner{fset, unused}
+	return &ObjPruner{fset, unused, nil}
 }
 
 func (op *ObjPruner) Update(node ast.Node) ast.Node {
@@ -132,8 +142,10 @@ func (op *ObjPruner) Update(node ast.Node) ast.Node {
 	case *ast.File:
 		var newDecls []ast.Decl
 		for _, decl := range n.Decls {
-			if decl := op.Update(decl); decl != nil {
-				newDecls = append(newDecls, decl.(ast.Decl))
+			if d := op.Update(decl); d != nil {
+				newDecls = append(newDecls, d.(ast.Decl))
+			} else {
+				op.removed = append(op.removed, decl)
 			}
 		}
 		n.Decls = newDecls
@@ -142,8 +154,10 @@ func (op *ObjPruner) Update(node ast.Node) ast.Node {
 		case token.CONST, token.TYPE, token.VAR:
 			var newSpecs []ast.Spec
 			for _, spec := range n.Specs {
-				if spec := op.Update(spec); spec != nil {
-					newSpecs = append(newSpecs, spec.(ast.Spec))
+				if s := op.Update(spec); s != nil {
+					newSpecs = append(newSpecs, s.(ast.Spec))
+				} else {
+					op.removed = append(op.removed, spec)
 				}
 			}
 			if newSpecs == nil {
@@ -168,8 +182,10 @@ func (op *ObjPruner) Update(node ast.Node) ast.Node {
 	case *ast.StructType:
 		var newFields []*ast.Field
 		for _, f := range n.Fields.List {
-			if f := op.Update(f); f != nil {
-				newFields = append(newFields, f.(*ast.Field))
+			if nf := op.Update(f); nf != nil {
+				newFields = append(newFields, nf.(*ast.Field))
+			} else {
+				op.removed = append(op.removed, f)
 			}
 		}
 		if newFields == nil {
@@ -239,3 +255,81 @@ func (op *ObjPruner) ShouldRemoveMethod(fd *ast.FuncDecl) bool {
 	}
 	return false
 }
+
+// objPos is the position of an object reported by unused.Checker.
+type objPos struct {
+	filename string
+	offset   int
+}
+
+// unusedOnAll reports whether the object at pos is unused on all the
+// platforms plats building its file. reported holds the positions of the
+// unused objects reported for each of the platforms.
+func unusedOnAll(plats []platform, reported []map[objPos]bool, pos objPos) bool {
+	for i, pl := range plats {
+		if reported[i][pos] {
+			continue
+		}
+		ctx := pl.context()
+		if ok, err := ctx.MatchFile(filepath.Dir(pos.filename), filepath.Base(pos.filename)); err != nil || ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUnused returns the unused objects of packages, fixing the files
+// the slicing made invalid first. It reports whether any file was fixed.
+func checkUnused(ch *unused.Checker, packages []string) (us []unused.Unused, fixed bool, err error) {
+	for i := 0; i < 15; i++ { // Don't loop forever.
+		us, err = ch.Check(packages)
+		if err == nil {
+			return us, fixed, nil
+		}
+
+		// Program slicing can make resulting programs invalid (because
+		// of unused imports or variables). Try to fix it.
+		if errs, ok := err.(unused.Error); ok {
+			invalid := make(map[token.Pos]*token.FileSet)
+			isSerious := false
+			for p, errs := range errs.Errors {
+				for _, err := range errs {
+					if terr, ok := err.(types.Error); ok {
+						invalid[terr.Pos] = terr.Fset
+						continue
+					}
+					// If there are other error types, report them
+					// and exit afterwards.
+					log.Printf("%s: %v", p, err)
+					isSerious = true
+				}
+			}
+			if !isSerious {
+				files := make(map[string][]int)
+				for p, fset := range invalid {
+					f := fset.File(p)
+					files[f.Name()] = append(files[f.Name()], f.Position(p).Offset)
+				}
+				names := make([]string, 0, len(files))
+				for f := range files {
+					names = append(names, f)
+				}
+				sort.Strings(names)
+				err := forEach(len(names), func(i int) error {
+					Verbosef("Fixing: %s @ %v", names[i], files[names[i]])
+					return fix(names[i], files[names[i]])
+				})
+				if err != nil {
+					return nil, fixed, err
+				}
+				sliceStats.Lock()
+				sliceStats.fixRuns++
+				sliceStats.Unlock()
+				fixed = true
+				continue
+			}
+		}
+		break
+	}
+	return nil, fixed, fmt.Errorf("checking unused packages: %v", err)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const watchInterval = 500 * time.Millisecond
+
+// watch slices tmplFile every time the template or any of the source
+// files feeding the cover program changes. Stages whose inputs didn't
+// change are skipped thanks to the cache, so a session-long cache is
+// used if caching was disabled. Watching ends when slicer is interrupted
+// or terminated; cleanup, which removes the temporary workspace, is
+// called then too.
+func watch(tmplFile string, cleanup func()) error {
+	sessionCache := ""
+	if *cacheDir == "" {
+		dir, err := ioutil.TempDir("", "slicer-cache-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		sessionCache, *cacheDir = dir, dir
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		<-sig
+		if sessionCache != "" {
+			os.RemoveAll(sessionCache)
+		}
+		cleanup()
+		os.Exit(1)
+	}()
+
+	var prev map[string][]byte
+	inputs := []string{tmplFile}
+	for {
+		// Edits made while slicing must trigger the next run, so
+		// the inputs are stamped before.
+		stamps := stampFiles(inputs)
+		started := time.Now()
+		if err := resetWorkspace(*workspace); err != nil {
+			return err
+		}
+		var err error
+		if inputs, err = slice(tmplFile); err != nil {
+			log.Print(err)
+		} else {
+			cur, err := readSliced(filepath.Join(*workspace, "src", dstPackage, "vendor"))
+			if err != nil {
+				return err
+			}
+			printSliceDiff(os.Stdout, prev, cur)
+			prev = cur
+		}
+		waitForChange(inputs, stamps, started)
+	}
+}
+
+// fileStamp returns the modification time of the file name, or the zero
+// time if it doesn't exist.
+func fileStamp(name string) time.Time {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// stampFiles returns the modification times of the files.
+func stampFiles(files []string) map[string]time.Time {
+	stamps := make(map[string]time.Time)
+	for _, f := range files {
+		stamps[f] = fileStamp(f)
+	}
+	return stamps
+}
+
+// waitForChange blocks until any of the files is modified, created or
+// removed. The files are compared to their stamps taken at the time
+// started; files without one count as modified if they were modified
+// since started.
+func waitForChange(files []string, stamps map[string]time.Time, started time.Time) {
+	base := make([]time.Time, len(files))
+	for i, f := range files {
+		t, ok := stamps[f]
+		if !ok {
+			if t = fileStamp(f); t.After(started) {
+				Verbosef("Changed: %s", f)
+				return
+			}
+		}
+		base[i] = t
+	}
+	for {
+		for i, f := range files {
+			if !fileStamp(f).Equal(base[i]) {
+				Verbosef("Changed: %s", f)
+				return
+			}
+		}
+		time.Sleep(watchInterval)
+	}
+}
+
+// readSliced reads all the files in the sliced vendor tree dir.
+func readSliced(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = b
+		return nil
+	})
+	return files, err
+}
+
+// printSliceDiff prints to w a summary of the changes between two
+// consecutive slicing results. Lines missing from cur are reported as
+// removed, lines that reappeared as restored.
+func printSliceDiff(w io.Writer, prev, cur map[string][]byte) {
+	if prev == nil {
+		fmt.Fprintf(w, "Sliced %d files\n", len(cur))
+		return
+	}
+	var names []string
+	for name := range prev {
+		names = append(names, name)
+	}
+	for name := range cur {
+		if _, ok := prev[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changed := 0
+	for _, name := range names {
+		old, new := prev[name], cur[name]
+		if bytes.Equal(old, new) {
+			continue
+		}
+		changed++
+		removed, restored := diffLines(old, new)
+		fmt.Fprintf(w, "  %s: %d lines removed, %d restored\n", name, removed, restored)
+	}
+	if changed == 0 {
+		fmt.Fprintln(w, "No changes in the sliced output")
+		return
+	}
+	fmt.Fprintf(w, "%d files touched\n", changed)
+}
+
+// diffLines counts the lines of old not present in new and vice versa.
+// Lines are compared as multisets, their order is ignored.
+func diffLines(old, new []byte) (removed, added int) {
+	count := make(map[string]int)
+	if len(old) > 0 {
+		for _, l := range bytes.Split(old, []byte("\n")) {
+			count[string(l)]++
+		}
+	}
+	if len(new) > 0 {
+		for _, l := range bytes.Split(new, []byte("\n")) {
+			count[string(l)]--
+		}
+	}
+	for _, n := range count {
+		if n > 0 {
+			removed += n
+		} else {
+			added -= n
+		}
+	}
+	return removed, added
+}
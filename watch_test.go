@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiffLines(t *testing.T) {
+	for _, tt := range []struct {
+		old, new       string
+		removed, added int
+	}{
+		{"", "", 0, 0},
+		{"", "a\nb", 0, 2},
+		{"a\nb", "", 2, 0},
+		{"a\nb\nc", "a\nb\nc", 0, 0},
+		{"a\nb\nc", "c\nb\na", 0, 0},
+		{"a\nb\nc", "a\nc", 1, 0},
+		{"a\nc", "a\nb\nc", 0, 1},
+		{"a\na\nb", "a\nb\nb", 1, 1},
+		{"x\n", "y\n", 1, 1},
+	} {
+		removed, added := diffLines([]byte(tt.old), []byte(tt.new))
+		if removed != tt.removed || added != tt.added {
+			t.Errorf("diffLines(%q, %q) = %d, %d; want %d, %d", tt.old, tt.new, removed, added, tt.removed, tt.added)
+		}
+	}
+}
+
+func TestPrintSliceDiff(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		prev, cur map[string][]byte
+		want      string
+	}{
+		{
+			"first run",
+			nil,
+			map[string][]byte{"p/a.go": []byte("a"), "p/b.go": []byte("b")},
+			"Sliced 2 files\n",
+		},
+		{
+			"unchanged",
+			map[string][]byte{"p/a.go": []byte("a\nb")},
+			map[string][]byte{"p/a.go": []byte("a\nb")},
+			"No changes in the sliced output\n",
+		},
+		{
+			"changed",
+			map[string][]byte{"p/a.go": []byte("a\nb\nc"), "p/b.go": []byte("x")},
+			map[string][]byte{"p/a.go": []byte("a\nd"), "p/b.go": []byte("x")},
+			"  p/a.go: 2 lines removed, 1 restored\n1 files touched\n",
+		},
+		{
+			"added and removed files",
+			map[string][]byte{"p/gone.go": []byte("a\nb")},
+			map[string][]byte{"p/new.go": []byte("c")},
+			"  p/gone.go: 2 lines removed, 0 restored\n  p/new.go: 0 lines removed, 1 restored\n2 files touched\n",
+		},
+	} {
+		var buf bytes.Buffer
+		printSliceDiff(&buf, tt.prev, tt.cur)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWaitForChangeDuringSlicing(t *testing.T) {
+	dir := t.TempDir()
+	old, added := filepath.Join(dir, "old.go"), filepath.Join(dir, "added.go")
+	if err := ioutil.WriteFile(old, []byte("package p\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+	stamps := stampFiles([]string{old})
+	started := time.Now()
+
+	// Edits made while slicing.
+	if err := ioutil.WriteFile(old, []byte("package p\n\nvar x int\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		waitForChange([]string{old}, stamps, started)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("edit of a stamped file missed")
+	}
+
+	if err := ioutil.WriteFile(added, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	done = make(chan bool)
+	go func() {
+		waitForChange([]string{added}, nil, started)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("edit of a new input missed")
+	}
+}
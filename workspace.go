@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// workspaceMarker is the file identifying a directory created by slicer.
+// Only such directories are ever removed.
+const workspaceMarker = ".slicer-workspace"
+
+// setupWorkspace prepares an empty workspace. If no workspace was given,
+// a temporary one is created. The returned function removes the
+// temporary workspace unless it should be kept.
+func setupWorkspace() (cleanup func(), err error) {
+	if *workspace != "" {
+		return func() {}, resetWorkspace(*workspace)
+	}
+	dir, err := os.MkdirTemp("", "slicer-ws-")
+	if err != nil {
+		return nil, err
+	}
+	*workspace = dir
+	if err := markWorkspace(dir); err != nil {
+		return nil, err
+	}
+	return func() {
+		if *keepWorkspace {
+			log.Printf("Workspace kept in %s", dir)
+			return
+		}
+		if err := removeWorkspace(dir); err != nil {
+			log.Print(err)
+		}
+	}, nil
+}
+
+// resetWorkspace removes the workspace dir, if it exists, and creates
+// a new empty one in its place.
+func resetWorkspace(dir string) error {
+	if err := removeWorkspace(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return markWorkspace(dir)
+}
+
+func markWorkspace(dir string) error {
+	return ioutil.WriteFile(filepath.Join(dir, workspaceMarker), nil, 0644)
+}
+
+// removeWorkspace removes dir. It refuses to remove a non-empty
+// directory that isn't marked as a workspace.
+func removeWorkspace(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		if _, err := os.Stat(filepath.Join(dir, workspaceMarker)); err != nil {
+			return fmt.Errorf("refusing to remove %s: not a slicer workspace (%s is missing)", dir, workspaceMarker)
+		}
+	}
+	return os.RemoveAll(dir)
+}
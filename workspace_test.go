@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveWorkspace(t *testing.T) {
+	dir := t.TempDir()
+
+	user := filepath.Join(dir, "user")
+	if err := os.Mkdir(user, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(user, "data"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeWorkspace(user); err == nil {
+		t.Errorf("removing %s: want error, got nil", user)
+	}
+	if _, err := os.Stat(filepath.Join(user, "data")); err != nil {
+		t.Errorf("user data removed: %v", err)
+	}
+
+	ws := filepath.Join(dir, "ws")
+	if err := resetWorkspace(ws); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(ws, "data"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeWorkspace(ws); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ws); !os.IsNotExist(err) {
+		t.Errorf("workspace %s not removed", ws)
+	}
+
+	if err := removeWorkspace(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("removing missing workspace: %v", err)
+	}
+}